@@ -1,9 +1,87 @@
+-- The postgres sink creates these tables when "migrate" is enabled; a change to this file also
+-- needs a new migration in internal/sink/postgres/migrations.
+
+-- Table shared by the Xiaomi (custom, pvvx and mibeacon firmwares), Ruuvi, Govee, SwitchBot and
+-- Aranet4 sensors; each driver only writes the columns it knows about, the others are left NULL.
 CREATE TABLE IF NOT EXISTS home_temperature (
   time TIMESTAMP NOT NULL,
   room text NOT NULL,
   temperature double PRECISION NULL,
   humidity double PRECISION NULL,
-  battery double PRECISION NULL
+  battery double PRECISION NULL,
+  -- sent by sensors running the pvvx firmware and by Ruuvi tags (mV)
+  voltage double PRECISION NULL,
+  -- only sent by sensors running the pvvx firmware
+  reed_switch boolean NULL,
+  trigger_output boolean NULL,
+  trigger_control boolean NULL,
+  temperature_trigger boolean NULL,
+  humidity_trigger boolean NULL,
+  -- sent by Ruuvi tags and Aranet4 devices (Pa)
+  pressure integer NULL,
+  -- only sent by Ruuvi tags
+  txpower integer NULL,
+  acceleration_x double PRECISION NULL,
+  acceleration_y double PRECISION NULL,
+  acceleration_z double PRECISION NULL,
+  movement_counter integer NULL,
+  sequence integer NULL,
+  -- sent by Ruuvi Air and Aranet4 devices (ppm)
+  co2 integer NULL,
+  -- only sent by Aranet4 devices: 1 green, 2 amber, 3 red
+  co2_status smallint NULL,
+  -- only sent by Ruuvi Air devices
+  pm1_0 double PRECISION NULL,
+  pm2_5 double PRECISION NULL,
+  pm4_0 double PRECISION NULL,
+  pm10 double PRECISION NULL,
+  voc integer NULL,
+  nox integer NULL,
+  luminosity double PRECISION NULL
 );
 
 SELECT create_hypertable('home_temperature', 'time');
+
+CREATE TABLE IF NOT EXISTS home_bthome (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  temperature double PRECISION NULL,
+  humidity double PRECISION NULL,
+  pressure double PRECISION NULL,
+  illuminance double PRECISION NULL,
+  battery double PRECISION NULL,
+  voltage double PRECISION NULL,
+  co2 integer NULL,
+  motion boolean NULL,
+  window boolean NULL,
+  button smallint NULL
+);
+
+SELECT create_hypertable('home_bthome', 'time');
+
+CREATE TABLE IF NOT EXISTS home_plants (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  temperature double PRECISION NULL,
+  moisture smallint NULL,
+  conductivity integer NULL,
+  lux integer NULL,
+  battery double PRECISION NULL
+);
+
+SELECT create_hypertable('home_plants', 'time');
+
+-- The statistics of each quantity over a storage interval, written when "stats_table" is set;
+-- quantity is the name of the column storing the quantity in the table of the sensor.
+CREATE TABLE IF NOT EXISTS sensor_stats (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  quantity text NOT NULL,
+  min double PRECISION NOT NULL,
+  max double PRECISION NOT NULL,
+  mean double PRECISION NOT NULL,
+  last double PRECISION NOT NULL,
+  samples integer NOT NULL
+);
+
+SELECT create_hypertable('sensor_stats', 'time');
@@ -0,0 +1,139 @@
+// Package ccm implements the AES-CCM mode (RFC 3610) used by the encrypted BLE advertisement
+// formats, since it's not available in the Go standard library.
+package ccm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrAuth is returned when a message fails the authentication check.
+var ErrAuth = errors.New("ccm: message authentication failed")
+
+// Open decrypts and authenticates a message; ciphertext must end with a tag of tagSize bytes.
+func Open(key, nonce, ciphertext, aad []byte, tagSize int) ([]byte, error) {
+	block, err := newBlock(key, nonce, tagSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < tagSize {
+		return nil, errors.New("ccm: ciphertext shorter than the tag")
+	}
+
+	tag := ciphertext[len(ciphertext)-tagSize:]
+	plaintext := make([]byte, len(ciphertext)-tagSize)
+	ctr(block, nonce, plaintext, ciphertext[:len(plaintext)])
+
+	expected := cbcMAC(block, nonce, plaintext, aad, tagSize)
+	s0 := counterBlock(nonce, 0)
+	block.Encrypt(s0, s0)
+	for i := range expected {
+		expected[i] ^= s0[i]
+	}
+
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, ErrAuth
+	}
+	return plaintext, nil
+}
+
+// Decrypt decrypts a message without checking its authentication tag, which must not be
+// part of ciphertext; it's only meant for legacy formats that don't send the full tag.
+func Decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := newBlock(key, nonce, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	ctr(block, nonce, plaintext, ciphertext)
+	return plaintext, nil
+}
+
+func newBlock(key, nonce []byte, tagSize int) (cipher.Block, error) {
+	if len(nonce) < 7 || len(nonce) > 13 {
+		return nil, fmt.Errorf("ccm: invalid nonce size %d", len(nonce))
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, fmt.Errorf("ccm: invalid tag size %d", tagSize)
+	}
+	return aes.NewCipher(key)
+}
+
+// counterBlock returns the block A_i: the flags, the nonce and the counter i.
+func counterBlock(nonce []byte, i uint64) []byte {
+	l := 15 - len(nonce)
+	b := make([]byte, aes.BlockSize)
+	b[0] = byte(l - 1)
+	copy(b[1:], nonce)
+	putCounter(b[1+len(nonce):], i)
+	return b
+}
+
+// putCounter writes v big endian in all of b.
+func putCounter(b []byte, v uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+// ctr encrypts (or decrypts) src into dst using the counter blocks A_1...A_n.
+func ctr(block cipher.Block, nonce, dst, src []byte) {
+	s := make([]byte, aes.BlockSize)
+	for i := 0; i*aes.BlockSize < len(src); i++ {
+		a := counterBlock(nonce, uint64(i+1))
+		block.Encrypt(s, a)
+
+		start := i * aes.BlockSize
+		end := start + aes.BlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		for j := start; j < end; j++ {
+			dst[j] = src[j] ^ s[j-start]
+		}
+	}
+}
+
+// cbcMAC computes the unencrypted authentication tag T of a message.
+func cbcMAC(block cipher.Block, nonce, plaintext, aad []byte, tagSize int) []byte {
+	l := 15 - len(nonce)
+	x := make([]byte, aes.BlockSize)
+
+	// B_0
+	x[0] = byte(((tagSize - 2) / 2) << 3)
+	x[0] |= byte(l - 1)
+	if len(aad) > 0 {
+		x[0] |= 1 << 6
+	}
+	copy(x[1:], nonce)
+	putCounter(x[1+len(nonce):], uint64(len(plaintext)))
+	block.Encrypt(x, x)
+
+	mac := func(data []byte) {
+		for len(data) > 0 {
+			n := 0
+			for ; n < aes.BlockSize && n < len(data); n++ {
+				x[n] ^= data[n]
+			}
+			block.Encrypt(x, x)
+			data = data[n:]
+		}
+	}
+
+	if len(aad) > 0 {
+		// the associated data is prefixed by its length; the formats we care about never send
+		// more than 0xFEFF bytes of it.
+		a := make([]byte, 2, 2+len(aad))
+		binary.BigEndian.PutUint16(a, uint16(len(aad)))
+		mac(append(a, aad...))
+	}
+	mac(plaintext)
+
+	return x[:tagSize]
+}
@@ -0,0 +1,175 @@
+package ccm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// the packet vectors of RFC 3610, section 8; the header of each packet is the associated data.
+var rfc3610 = []struct {
+	name       string
+	key        string
+	nonce      string
+	header     string
+	plaintext  string
+	ciphertext string // with the tag
+	tagSize    int
+}{
+	{
+		name:       "packet vector #1",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000003020100a0a1a2a3a4a5",
+		header:     "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		ciphertext: "588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0",
+		tagSize:    8,
+	},
+	{
+		name:       "packet vector #2",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000004030201a0a1a2a3a4a5",
+		header:     "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		ciphertext: "72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3ba091d56e10400916",
+		tagSize:    8,
+	},
+	{
+		name:       "packet vector #3",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000005040302a0a1a2a3a4a5",
+		header:     "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		ciphertext: "51b1e5f44a197d1da46b0f8e2d282ae871e838bb64da8596574adaa76fbd9fb0c5",
+		tagSize:    8,
+	},
+	{
+		name:       "packet vector #4",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000006050403a0a1a2a3a4a5",
+		header:     "000102030405060708090a0b",
+		plaintext:  "0c0d0e0f101112131415161718191a1b1c1d1e",
+		ciphertext: "a28c6865939a9a79faaa5c4c2a9d4a91cdac8c96c861b9c9e61ef1",
+		tagSize:    8,
+	},
+	{
+		name:       "packet vector #7",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000009080706a0a1a2a3a4a5",
+		header:     "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		ciphertext: "0135d1b2c95f41d5d1d4fec185d166b8094e999dfed96c048c56602c97acbb7490",
+		tagSize:    10,
+	},
+	{
+		name:       "packet vector #12",
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "0000000e0d0c0ba0a1a2a3a4a5",
+		header:     "000102030405060708090a0b",
+		plaintext:  "0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		ciphertext: "c0ffa0d6f05bdb67f24d43a4338d2aa4bed7b20e43cd1aa31662e7ad65d6db",
+		tagSize:    10,
+	},
+	{
+		name:       "packet vector #13",
+		key:        "d7828d13b2b0bdc325a76236df93cc6b",
+		nonce:      "00412b4ea9cdbe3c9696766cfa",
+		header:     "0be1a88bace018b1",
+		plaintext:  "08e8cf97d820ea258460e96ad9cf5289054d895ceac47c",
+		ciphertext: "4cb97f86a2a4689a877947ab8091ef5386a6ffbdd080f8e78cf7cb0cddd7b3",
+		tagSize:    8,
+	},
+	{
+		name:       "packet vector #24",
+		key:        "d7828d13b2b0bdc325a76236df93cc6b",
+		nonce:      "008d493b30ae8b3c9696766cfa",
+		header:     "6e37a6ef546d955d34ab6059",
+		plaintext:  "abf21c0b02feb88f856df4a37381bce3cc128517d4",
+		ciphertext: "f32905b88a641b04b9c9ffb58cc390900f3da12ab16dce9e82efa16da62059",
+		tagSize:    10,
+	},
+}
+
+func TestOpen(t *testing.T) {
+	for _, tt := range rfc3610 {
+		t.Run(tt.name, func(t *testing.T) {
+			key, nonce, header := unhex(t, tt.key), unhex(t, tt.nonce), unhex(t, tt.header)
+			plaintext, ciphertext := unhex(t, tt.plaintext), unhex(t, tt.ciphertext)
+
+			got, err := Open(key, nonce, ciphertext, header, tt.tagSize)
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("Open = %x, want %x", got, plaintext)
+			}
+
+			// any change to the message, the tag or the associated data fails the authentication.
+			for _, i := range []int{0, len(ciphertext) - 1} {
+				tampered := append([]byte(nil), ciphertext...)
+				tampered[i] ^= 0x01
+				if _, err := Open(key, nonce, tampered, header, tt.tagSize); !errors.Is(err, ErrAuth) {
+					t.Errorf("Open with byte %d modified: got error %v, want ErrAuth", i, err)
+				}
+			}
+			tampered := append([]byte(nil), header...)
+			tampered[0] ^= 0x01
+			if _, err := Open(key, nonce, ciphertext, tampered, tt.tagSize); !errors.Is(err, ErrAuth) {
+				t.Errorf("Open with modified associated data: got error %v, want ErrAuth", err)
+			}
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	for _, tt := range rfc3610 {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, ciphertext := unhex(t, tt.plaintext), unhex(t, tt.ciphertext)
+
+			got, err := Decrypt(unhex(t, tt.key), unhex(t, tt.nonce), ciphertext[:len(ciphertext)-tt.tagSize])
+			if err != nil {
+				t.Fatalf("Decrypt: %s", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("Decrypt = %x, want %x", got, plaintext)
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	key := unhex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf")
+
+	tests := []struct {
+		name       string
+		key        []byte
+		nonce      []byte
+		ciphertext []byte
+		tagSize    int
+	}{
+		{"short nonce", key, make([]byte, 6), make([]byte, 8), 4},
+		{"long nonce", key, make([]byte, 14), make([]byte, 8), 4},
+		{"short tag", key, make([]byte, 12), make([]byte, 8), 2},
+		{"long tag", key, make([]byte, 12), make([]byte, 20), 18},
+		{"odd tag", key, make([]byte, 12), make([]byte, 8), 5},
+		{"invalid key", key[:10], make([]byte, 12), make([]byte, 8), 4},
+		{"ciphertext shorter than the tag", key, make([]byte, 12), make([]byte, 3), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Open(tt.key, tt.nonce, tt.ciphertext, nil, tt.tagSize); err == nil {
+				t.Error("Open succeeded, want an error")
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -16,20 +18,58 @@ import (
 type Config struct {
 	HomeKit  HomeKit        `toml:"homekit"`
 	Sensors  []SensorConfig `toml:"sensors"`
-	Interval duration       `toml:"interval"`
-	DBConfig string         `toml:"dbconfig"`
+	Sinks    []SinkConfig   `toml:"sinks"`
+	Metrics  Metrics        `toml:"metrics"`
+	MQTT     MQTT           `toml:"mqtt"`
+	Interval duration       `toml:"interval"` // how often the readings are stored
+	DBConfig string         `toml:"dbconfig"` // shorthand for a "postgres" sink
+
+	// HomeKitInterval is how often the readings are sent to HomeKit; it defaults to 2 minutes.
+	HomeKitInterval duration `toml:"homekit_interval"`
+
+	// StaleTimeout is how long the last reading of a sensor is considered current; it defaults to
+	// 30 minutes.
+	StaleTimeout duration `toml:"stale_timeout"`
 }
 
 func (c Config) Validate() error {
 	err := validation.ValidateStruct(&c,
 		validation.Field(&c.HomeKit, validation.Required),
 		validation.Field(&c.Sensors, validation.Required),
-		validation.Field(&c.Interval, validation.Required),
-		validation.Field(&c.DBConfig, validation.Required),
+		validation.Field(&c.Sinks),
+		validation.Field(&c.Interval, requiredDuration),
+		validation.Field(&c.HomeKitInterval),
+		validation.Field(&c.StaleTimeout),
 	)
 	return err
 }
 
+// StoreInterval returns how often the readings of a sensor are stored.
+func (c *Config) StoreInterval(sc *SensorConfig) time.Duration {
+	if sc.Interval.Duration != 0 {
+		return sc.Interval.Duration
+	}
+	return c.Interval.Duration
+}
+
+// HomeKitUpdateInterval returns how often the readings of a sensor are sent to HomeKit, or 0 for the
+// default.
+func (c *Config) HomeKitUpdateInterval(sc *SensorConfig) time.Duration {
+	if sc.HomeKitInterval.Duration != 0 {
+		return sc.HomeKitInterval.Duration
+	}
+	return c.HomeKitInterval.Duration
+}
+
+// StaleAfter returns how long the last reading of a sensor is considered current, or 0 for the
+// default.
+func (c *Config) StaleAfter(sc *SensorConfig) time.Duration {
+	if sc.StaleTimeout.Duration != 0 {
+		return sc.StaleTimeout.Duration
+	}
+	return c.StaleTimeout.Duration
+}
+
 type HomeKit struct {
 	Pin     string `toml:"pin"`
 	Port    int    `toml:"port"`
@@ -46,20 +86,163 @@ func (hk HomeKit) Validate() error {
 	return err
 }
 
+// Metrics contains the configuration of the Prometheus exporter.
+type Metrics struct {
+	Listen string `toml:"listen"` // address of the HTTP listener, e.g. ":9110"; empty to disable
+}
+
+// MQTT contains the configuration of the MQTT publisher.
+type MQTT struct {
+	Broker          string `toml:"broker"` // e.g. "tcp://localhost:1883"; empty to disable
+	ClientID        string `toml:"client_id"`
+	Username        string `toml:"username"`
+	Password        string `toml:"password"`
+	TopicPrefix     string `toml:"topic_prefix"`     // defaults to "sensor-probe"
+	DiscoveryPrefix string `toml:"discovery_prefix"` // defaults to "homeassistant"
+}
+
 // SensorConfig contains the configuration of a single sensor.
 type SensorConfig struct {
 	Name     string `toml:"name"`
 	MAC      string `toml:"mac"`
 	Firmware string `toml:"firmware"`
-	DBTable  string `toml:"dbtable"`
+	DBTable  string `toml:"dbtable"` // table used by the database sinks; the sensor isn't stored if empty
+	BindKey  string `toml:"bindkey"` // hex encoded encryption key, for the sensors sending encrypted data
+
+	// Interval, HomeKitInterval and StaleTimeout override the global settings for this sensor.
+	Interval        duration `toml:"interval"`
+	HomeKitInterval duration `toml:"homekit_interval"`
+	StaleTimeout    duration `toml:"stale_timeout"`
+
+	// Decoder describes the advertisements of the sensors using the "generic" firmware.
+	Decoder *Decoder `toml:"decoder"`
 }
 
+// Validate checks the settings common to all sensors; the firmware name and any driver specific
+// setting are checked by the sensor drivers registry when the probe starts.
 func (sc SensorConfig) Validate() error {
 	err := validation.ValidateStruct(&sc,
 		validation.Field(&sc.Name, validation.Required),
 		validation.Field(&sc.MAC, validation.Required, is.MAC),
-		validation.Field(&sc.Firmware, validation.Required, validation.In("custom", "ruuviv5")),
-		validation.Field(&sc.DBTable, validation.Required),
+		validation.Field(&sc.Firmware, validation.Required),
+		validation.Field(&sc.DBTable, validation.Match(tableRe).Error("must be a lowercase table name, optionally qualified by its schema")),
+		validation.Field(&sc.BindKey, is.Hexadecimal),
+		validation.Field(&sc.Interval),
+		validation.Field(&sc.HomeKitInterval),
+		validation.Field(&sc.StaleTimeout),
+		validation.Field(&sc.Decoder),
+	)
+	return err
+}
+
+// Decoder describes how to find and decode the measurements in the advertisements of a sensor;
+// the offsets and the length refer to the whole advertising data, including the manufacturer ID
+// or the service UUID.
+type Decoder struct {
+	AdType      string  `toml:"ad_type"`      // "manufacturer" or "service_data"
+	ID          *uint16 `toml:"id"`           // manufacturer ID or 16 bit service UUID, if any
+	Length      int     `toml:"length"`       // length of the advertising data, 0 for any length
+	AddressType string  `toml:"address_type"` // "public" (the default) or "random"
+	Fields      []Field `toml:"fields"`
+}
+
+func (d Decoder) Validate() error {
+	err := validation.ValidateStruct(&d,
+		validation.Field(&d.AdType, validation.Required, validation.In("manufacturer", "service_data")),
+		validation.Field(&d.ID, validation.When(d.Length == 0, validation.NotNil.Error("either id or length is required"))),
+		validation.Field(&d.Length, validation.Min(0)),
+		validation.Field(&d.AddressType, validation.In("public", "random")),
+		validation.Field(&d.Fields, validation.Required),
+	)
+	return err
+}
+
+// Field describes a single value in the advertising data; the value is multiplied by Scale.
+type Field struct {
+	Name   string  `toml:"name"`   // column name; "temperature" and "humidity" are also sent to HomeKit
+	Offset int     `toml:"offset"` // offset of the first byte
+	Width  int     `toml:"width"`  // size in bytes, from 1 to 4
+	Endian string  `toml:"endian"` // "little" (the default) or "big"
+	Signed bool    `toml:"signed"`
+	Scale  float64 `toml:"scale"` // defaults to 1
+	Unit   string  `toml:"unit"`
+}
+
+func (f Field) Validate() error {
+	err := validation.ValidateStruct(&f,
+		validation.Field(&f.Name, validation.Required, validation.Match(identifierRe)),
+		validation.Field(&f.Offset, validation.Min(0)),
+		validation.Field(&f.Width, validation.Required, validation.Min(1), validation.Max(4)),
+		validation.Field(&f.Endian, validation.In("little", "big")),
+	)
+	return err
+}
+
+// identifierRe matches the names that can be used as column names without quoting.
+var identifierRe = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// tableRe matches the table names, optionally qualified by their schema; they're quoted when used
+// in a query, so they must be lowercase to match the tables created without quotes.
+var tableRe = regexp.MustCompile(`^([a-z_][a-z0-9_]{0,62}\.)?[a-z_][a-z0-9_]{0,62}$`)
+
+// SinkConfig contains the configuration of a storage backend; the backend type is checked by the
+// sinks registry when the probe starts.
+type SinkConfig struct {
+	Type string `toml:"type"`
+	DSN  string `toml:"dsn"`  // connection string, for the database backends
+	Path string `toml:"path"` // database file, for the sqlite backend
+
+	// Migrate makes the postgres backend create the tables of doc/schema.sql, add the columns
+	// they're missing, and create the tables of the sensors, when the probe starts; otherwise the
+	// tables of the sensors must exist.
+	Migrate bool `toml:"migrate"`
+
+	// StatsTable, if set, is the table where the database backends write the minimum, maximum,
+	// mean and last value of each quantity received during the storage interval, and the number
+	// of samples.
+	StatsTable string `toml:"stats_table"`
+
+	// BatchSize is the number of buffered readings that makes the postgres backend write them
+	// before the end of the storage round; it defaults to 1000.
+	BatchSize int `toml:"batch_size"`
+
+	// SpoolDir, if set, is the directory where the points that couldn't be written are kept
+	// until the backend works again; SpoolMaxSize is the maximum size of the spool in bytes.
+	SpoolDir     string `toml:"spool_dir"`
+	SpoolMaxSize int64  `toml:"spool_max_size"`
+
+	// InfluxDB settings.
+	URL         string            `toml:"url"`
+	Version     int               `toml:"version"` // 1 or 2 (the default)
+	Token       string            `toml:"token"`   // API token; "user:password" for InfluxDB 1.x
+	Org         string            `toml:"org"`
+	Bucket      string            `toml:"bucket"`
+	Database    string            `toml:"database"`
+	Measurement string            `toml:"measurement"` // defaults to "sensors"
+	Tags        []string          `toml:"tags"`        // any of "sensor", "mac" and "firmware"; defaults to all
+	StaticTags  map[string]string `toml:"static_tags"` // added to every point, e.g. the site name
+
+	// Tables are the tables set in the "dbtable" setting of the sensors, filled in when the probe
+	// starts, so that the database backends can create them before the first write.
+	Tables []Table `toml:"-"`
+}
+
+// Table is a table written by the sensors; Schema is the table of doc/schema.sql whose columns it
+// must have.
+type Table struct {
+	Name   string
+	Schema string
+}
+
+func (sc SinkConfig) Validate() error {
+	err := validation.ValidateStruct(&sc,
+		validation.Field(&sc.Type, validation.Required),
+		validation.Field(&sc.URL, is.URL),
+		validation.Field(&sc.Version, validation.In(0, 1, 2)),
+		validation.Field(&sc.StatsTable, validation.Match(tableRe).Error("must be a lowercase table name, optionally qualified by its schema")),
+		validation.Field(&sc.BatchSize, validation.Min(0)),
+		validation.Field(&sc.SpoolMaxSize, validation.Min(int64(0))),
+		validation.Field(&sc.Tags, validation.Each(validation.In("sensor", "mac", "firmware"))),
 	)
 	return err
 }
@@ -73,6 +256,22 @@ func (i *duration) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+// requiredDuration rejects the durations that are not set; validation.Required doesn't, since it
+// only checks the struct.
+var requiredDuration = validation.By(func(value interface{}) error {
+	if d, ok := value.(duration); ok && d.Duration <= 0 {
+		return validation.ErrRequired
+	}
+	return nil
+})
+
+func (i duration) Validate() error {
+	if i.Duration != 0 && i.Duration < time.Second {
+		return errors.New("must be at least 1s")
+	}
+	return nil
+}
+
 func ReadConfig(filename string) (*Config, error) {
 	fh, err := os.Open(filename)
 	if err != nil {
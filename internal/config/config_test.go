@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTableNames(t *testing.T) {
+	tests := []struct {
+		table string
+		valid bool
+	}{
+		{"home_temperature", true},
+		{"public.home_temperature", true},
+		{"_sensors2", true},
+		{"", true}, // the sensor isn't stored
+		{"Home_Temperature", false},
+		{"public.HOME", false},
+		{"Public.home", false},
+		{"2sensors", false},
+		{"home-temperature", false},
+		{"a.b.c", false},
+		{`home"; DROP TABLE x; --`, false},
+		{"a234567890123456789012345678901234567890123456789012345678901234", false},
+	}
+
+	for _, tt := range tests {
+		sensor := SensorConfig{Name: "bedroom", MAC: "A4:C1:38:01:01:01", Firmware: "pvvx", DBTable: tt.table}
+		if err := sensor.Validate(); (err == nil) != tt.valid {
+			t.Errorf("dbtable %q: got error %v, want valid = %v", tt.table, err, tt.valid)
+		}
+
+		sink := SinkConfig{Type: "postgres", StatsTable: tt.table}
+		if err := sink.Validate(); (err == nil) != tt.valid {
+			t.Errorf("stats_table %q: got error %v, want valid = %v", tt.table, err, tt.valid)
+		}
+	}
+}
+
+func TestReadConfigInterval(t *testing.T) {
+	const base = `
+[homekit]
+    pin = "00102003"
+    port = 12345
+    setup_id = "ABCD"
+    data_dir = "/tmp/sensor-probe"
+
+[[sensors]]
+    name = "bedroom"
+    mac = "a4:c1:38:01:01:01"
+    firmware = "pvvx"
+`
+
+	tests := []struct {
+		name     string
+		settings string
+		want     time.Duration
+	}{
+		{name: "set", settings: `interval = "5m"`, want: 5 * time.Minute},
+		{name: "missing"},
+		{name: "zero", settings: `interval = "0s"`},
+		{name: "negative", settings: `interval = "-1m"`},
+		{name: "too short", settings: `interval = "500ms"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.toml")
+			if err := os.WriteFile(filename, []byte(tt.settings+"\n"+base), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := ReadConfig(filename)
+			if tt.want == 0 {
+				if err == nil {
+					t.Fatalf("ReadConfig succeeded with interval %s, want an error", config.Interval.Duration)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadConfig: %s", err)
+			}
+			if got := config.StoreInterval(&config.Sensors[0]); got != tt.want {
+				t.Errorf("got interval %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
 	"github.com/piger/sensor-probe/internal/config"
 	"rsc.io/qr"
@@ -44,6 +45,9 @@ type TemperatureHumiditySensor struct {
 	*accessory.Accessory
 	TemperatureSensor *service.TemperatureSensor
 	HumiditySensor    *service.HumiditySensor
+
+	statusActive []*characteristic.StatusActive
+	statusFault  []*characteristic.StatusFault
 }
 
 func NewTemperatureHumiditySensor(info accessory.Info) *TemperatureHumiditySensor {
@@ -51,14 +55,115 @@ func NewTemperatureHumiditySensor(info accessory.Info) *TemperatureHumiditySenso
 	acc.Accessory = accessory.New(info, accessory.TypeThermostat)
 
 	acc.TemperatureSensor = service.NewTemperatureSensor()
-	acc.AddService(acc.TemperatureSensor.Service)
+	acc.addSensorService(acc.TemperatureSensor.Service)
 
 	acc.HumiditySensor = service.NewHumiditySensor()
-	acc.AddService(acc.HumiditySensor.Service)
+	acc.addSensorService(acc.HumiditySensor.Service)
+
+	return &acc
+}
+
+// addSensorService adds a sensor service to the accessory, along with the characteristics telling
+// whether the sensor is working.
+func (acc *TemperatureHumiditySensor) addSensorService(s *service.Service) {
+	active := characteristic.NewStatusActive()
+	active.SetValue(true)
+	s.AddCharacteristic(active.Characteristic)
+	acc.statusActive = append(acc.statusActive, active)
+
+	fault := characteristic.NewStatusFault()
+	fault.SetValue(characteristic.StatusFaultNoFault)
+	s.AddCharacteristic(fault.Characteristic)
+	acc.statusFault = append(acc.statusFault, fault)
+
+	acc.AddService(s)
+}
+
+// SetActive marks the services of the accessory as working, or as inactive and faulty when the
+// sensor stopped sending readings.
+func (acc *TemperatureHumiditySensor) SetActive(active bool) {
+	fault := characteristic.StatusFaultNoFault
+	if !active {
+		fault = characteristic.StatusFaultGeneralFault
+	}
+
+	for _, c := range acc.statusActive {
+		c.SetValue(active)
+	}
+	for _, c := range acc.statusFault {
+		c.SetValue(fault)
+	}
+}
+
+// PlantSensor is a TemperatureHumiditySensor whose humidity service reports the soil moisture,
+// with an additional light sensor.
+type PlantSensor struct {
+	*TemperatureHumiditySensor
+	LightSensor *service.LightSensor
+}
+
+func NewPlantSensor(info accessory.Info) *PlantSensor {
+	acc := PlantSensor{}
+	acc.TemperatureHumiditySensor = NewTemperatureHumiditySensor(info)
+
+	acc.LightSensor = service.NewLightSensor()
+	acc.addSensorService(acc.LightSensor.Service)
+
+	return &acc
+}
+
+// AirQualitySensor is a TemperatureHumiditySensor with additional carbon dioxide and air
+// quality services.
+type AirQualitySensor struct {
+	*TemperatureHumiditySensor
+	CarbonDioxideSensor *service.CarbonDioxideSensor
+	CarbonDioxideLevel  *characteristic.CarbonDioxideLevel
+	AirQualitySensor    *service.AirQualitySensor
+}
+
+func NewAirQualitySensor(info accessory.Info) *AirQualitySensor {
+	acc := AirQualitySensor{}
+	acc.TemperatureHumiditySensor = NewTemperatureHumiditySensor(info)
+
+	acc.CarbonDioxideSensor = service.NewCarbonDioxideSensor()
+	acc.CarbonDioxideLevel = characteristic.NewCarbonDioxideLevel()
+	acc.CarbonDioxideSensor.AddCharacteristic(acc.CarbonDioxideLevel.Characteristic)
+	acc.addSensorService(acc.CarbonDioxideSensor.Service)
+
+	acc.AirQualitySensor = service.NewAirQualitySensor()
+	acc.addSensorService(acc.AirQualitySensor.Service)
 
 	return &acc
 }
 
+// SetCarbonDioxide sets the CO2 level, in ppm, and the air quality derived from it; abnormal
+// signals that the level is above the threshold of the device.
+func (a *AirQualitySensor) SetCarbonDioxide(ppm float64, abnormal bool) {
+	a.CarbonDioxideLevel.SetValue(ppm)
+	if abnormal {
+		a.CarbonDioxideSensor.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsAbnormal)
+	} else {
+		a.CarbonDioxideSensor.CarbonDioxideDetected.SetValue(characteristic.CarbonDioxideDetectedCO2LevelsNormal)
+	}
+	a.AirQualitySensor.AirQuality.SetValue(airQualityFromCO2(ppm))
+}
+
+// airQualityFromCO2 maps a CO2 level to the HomeKit air quality scale.
+func airQualityFromCO2(ppm float64) int {
+	switch {
+	case ppm < 600:
+		return characteristic.AirQualityExcellent
+	case ppm < 1000:
+		return characteristic.AirQualityGood
+	case ppm < 1400:
+		return characteristic.AirQualityFair
+	case ppm < 2000:
+		return characteristic.AirQualityInferior
+	default:
+		return characteristic.AirQualityPoor
+	}
+}
+
 func SetupHomeKit(config *config.HomeKit, accs []*accessory.Accessory) (HomeKitTransport, error) {
 	hkBridge := accessory.NewBridge(accessory.Info{
 		Name:         "Sensor Probe",
@@ -0,0 +1,158 @@
+// Package metrics exports the sensor readings as Prometheus metrics.
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sensor_probe"
+
+var labelNames = []string{"sensor", "mac", "firmware"}
+
+// gauge exports a quantity, converted to the base unit of the metric.
+type gauge struct {
+	vec     *prometheus.GaugeVec
+	convert map[sensors.Unit]float64 // factors from the other units to the base unit
+}
+
+// Exporter keeps the latest reading of each sensor as a set of gauges.
+type Exporter struct {
+	registry *prometheus.Registry
+	gauges   map[sensors.Quantity]*gauge
+	rssi     *prometheus.GaugeVec
+	lastSeen *prometheus.GaugeVec
+	stale    *prometheus.GaugeVec
+	invalid  *prometheus.CounterVec
+}
+
+func newGaugeVec(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, labelNames)
+}
+
+// NewExporter creates an exporter with its own registry.
+func NewExporter() *Exporter {
+	e := Exporter{
+		registry: prometheus.NewRegistry(),
+		gauges: map[sensors.Quantity]*gauge{
+			sensors.Temperature: {vec: newGaugeVec("temperature_celsius", "Temperature in degrees Celsius.")},
+			sensors.Humidity:    {vec: newGaugeVec("humidity_percent", "Relative humidity in percent.")},
+			sensors.Pressure: {
+				vec:     newGaugeVec("pressure_pascals", "Atmospheric pressure in pascals."),
+				convert: map[sensors.Unit]float64{sensors.UnitHectoPascal: 100},
+			},
+			sensors.Battery: {vec: newGaugeVec("battery_percent", "Battery level in percent.")},
+			sensors.Voltage: {
+				vec:     newGaugeVec("voltage_volts", "Battery voltage in volts."),
+				convert: map[sensors.Unit]float64{sensors.UnitMillivolt: 0.001},
+			},
+			sensors.TxPower: {vec: newGaugeVec("tx_power_dbm", "Transmission power in dBm.")},
+		},
+		rssi:     newGaugeVec("rssi_dbm", "Received signal strength of the last advertisement in dBm."),
+		lastSeen: newGaugeVec("last_seen_timestamp_seconds", "Time of the last reading, in seconds since the epoch."),
+		stale:    newGaugeVec("stale", "Whether the sensor stopped sending readings (1) or not (0)."),
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "invalid_values_total",
+			Help:      "Number of values that the sensor reported as not available.",
+		}, []string{"sensor", "mac", "firmware", "measurement"}),
+	}
+
+	for _, g := range e.gauges {
+		e.registry.MustRegister(g.vec)
+	}
+	e.registry.MustRegister(e.rssi, e.lastSeen, e.stale, e.invalid)
+
+	return &e
+}
+
+// Observe updates the gauges of a sensor with a new reading.
+func (e *Exporter) Observe(r *sensors.Reading) {
+	labels := prometheus.Labels{"sensor": r.Name, "mac": r.MAC, "firmware": r.Firmware}
+
+	for _, m := range r.Measurements {
+		g, ok := e.gauges[m.Quantity]
+		if !ok {
+			continue
+		}
+		v := m.Value
+		if factor, ok := g.convert[m.Unit]; ok {
+			v *= factor
+		}
+		g.vec.With(labels).Set(v)
+	}
+
+	e.rssi.With(labels).Set(float64(r.RSSI))
+	e.lastSeen.With(labels).Set(float64(r.Time.UnixNano()) / float64(time.Second))
+	e.stale.With(labels).Set(0)
+}
+
+// ObserveStale records that a sensor stopped sending readings, or that it's sending them again.
+func (e *Exporter) ObserveStale(s *sensors.Sensor, stale bool) {
+	labels := prometheus.Labels{"sensor": s.Name, "mac": s.MAC, "firmware": s.Firmware}
+
+	var v float64
+	if stale {
+		v = 1
+	}
+	e.stale.With(labels).Set(v)
+}
+
+// ObserveInvalid counts a value that a sensor reported as not available.
+func (e *Exporter) ObserveInvalid(s *sensors.Sensor, name string) {
+	e.invalid.With(prometheus.Labels{"sensor": s.Name, "mac": s.MAC, "firmware": s.Firmware, "measurement": name}).Inc()
+}
+
+// AddSpool exports the number of points waiting in the spool of a sink, and the age of the oldest
+// one; stats is called on every scrape.
+func (e *Exporter) AddSpool(name string, stats func() (int, time.Time)) {
+	labels := prometheus.Labels{"sink": name}
+
+	e.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "spool_points",
+			Help:        "Number of points waiting in the spool of a sink.",
+			ConstLabels: labels,
+		}, func() float64 {
+			depth, _ := stats()
+			return float64(depth)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "spool_oldest_age_seconds",
+			Help:        "Age of the oldest point waiting in the spool of a sink, in seconds.",
+			ConstLabels: labels,
+		}, func() float64 {
+			depth, oldest := stats()
+			if depth == 0 {
+				return 0
+			}
+			return time.Since(oldest).Seconds()
+		}),
+	)
+}
+
+// Serve exposes the metrics under /metrics on the listener.
+func (e *Exporter) Serve(listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}))
+
+	server := http.Server{
+		Handler:        mux,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	return server.Serve(listener)
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveInvalid(t *testing.T) {
+	e := NewExporter()
+	s := &sensors.Sensor{Name: "garden", MAC: "c1:b8:33:4c:88:4f", Firmware: "ruuviv5", OnInvalid: e.ObserveInvalid}
+
+	s.CountInvalid("humidity")
+	s.CountInvalid("humidity")
+	s.CountInvalid("pressure")
+
+	expected := `
+# HELP sensor_probe_invalid_values_total Number of values that the sensor reported as not available.
+# TYPE sensor_probe_invalid_values_total counter
+sensor_probe_invalid_values_total{firmware="ruuviv5",mac="c1:b8:33:4c:88:4f",measurement="humidity",sensor="garden"} 2
+sensor_probe_invalid_values_total{firmware="ruuviv5",mac="c1:b8:33:4c:88:4f",measurement="pressure",sensor="garden"} 1
+`
+	if err := testutil.GatherAndCompare(e.registry, strings.NewReader(expected), "sensor_probe_invalid_values_total"); err != nil {
+		t.Error(err)
+	}
+}
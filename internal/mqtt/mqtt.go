@@ -0,0 +1,326 @@
+// Package mqtt publishes the sensor readings to an MQTT broker, along with the Home Assistant
+// discovery messages describing the sensors.
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+)
+
+const (
+	defaultClientID        = "sensor-probe"
+	defaultTopicPrefix     = "sensor-probe"
+	defaultDiscoveryPrefix = "homeassistant"
+
+	payloadOnline  = "online"
+	payloadOffline = "offline"
+
+	publishTimeout = 10 * time.Second
+)
+
+// quantityInfo describes how a quantity is presented in Home Assistant.
+type quantityInfo struct {
+	name        string
+	deviceClass string
+}
+
+var quantities = map[sensors.Quantity]quantityInfo{
+	sensors.Temperature:  {"Temperature", "temperature"},
+	sensors.Humidity:     {"Humidity", "humidity"},
+	sensors.Pressure:     {"Pressure", "pressure"},
+	sensors.Battery:      {"Battery", "battery"},
+	sensors.Voltage:      {"Voltage", "voltage"},
+	sensors.Illuminance:  {"Illuminance", "illuminance"},
+	sensors.Moisture:     {"Moisture", "moisture"},
+	sensors.Conductivity: {"Conductivity", ""},
+	sensors.CO2:          {"CO2", "carbon_dioxide"},
+	sensors.PM1:          {"PM1", "pm1"},
+	sensors.PM25:         {"PM2.5", "pm25"},
+	sensors.PM10:         {"PM10", "pm10"},
+	sensors.TxPower:      {"TX power", "signal_strength"},
+	sensors.Motion:       {"Motion", "motion"},
+	sensors.Window:       {"Window", "window"},
+	sensors.ReedSwitch:   {"Reed switch", "opening"},
+}
+
+// rssiKey is the key of the RSSI in the state messages.
+const rssiKey = "rssi"
+
+var slugRe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// slug turns a sensor name into a topic level.
+func slug(name string) string {
+	return strings.Trim(slugRe.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+// Publisher publishes every reading as a JSON object to <prefix>/<sensor>/state; the availability of
+// the probe is published to <prefix>/status, and set to "offline" by the broker when the probe
+// disconnects.
+type Publisher struct {
+	client          paho.Client
+	topicPrefix     string
+	discoveryPrefix string
+
+	mu sync.Mutex
+	// the quantities announced to Home Assistant, by sensor MAC address.
+	announced map[string]map[sensors.Quantity]bool
+}
+
+// checkNames returns an error if two sensor names have the same slug, since the sensors would
+// share their topics.
+func checkNames(names []string) error {
+	seen := make(map[string]string)
+	for _, name := range names {
+		s := slug(name)
+		if s == "" {
+			return fmt.Errorf("sensor %q: the name can't be used in a MQTT topic", name)
+		}
+		if other, dup := seen[s]; dup {
+			return fmt.Errorf("sensors %q and %q would both publish to the MQTT topic %q", other, name, s)
+		}
+		seen[s] = name
+	}
+	return nil
+}
+
+// NewPublisher connects to the broker, after checking that each of the sensors has its own topic;
+// the connection is retried in the background until it succeeds.
+func NewPublisher(cfg *config.MQTT, names []string) (*Publisher, error) {
+	if err := checkNames(names); err != nil {
+		return nil, err
+	}
+
+	p := Publisher{
+		topicPrefix:     cfg.TopicPrefix,
+		discoveryPrefix: cfg.DiscoveryPrefix,
+		announced:       make(map[string]map[sensors.Quantity]bool),
+	}
+	if p.topicPrefix == "" {
+		p.topicPrefix = defaultTopicPrefix
+	}
+	if p.discoveryPrefix == "" {
+		p.discoveryPrefix = defaultDiscoveryPrefix
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = defaultClientID
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetWill(p.statusTopic(), payloadOffline, 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("MQTT connection lost: %s", err)
+		})
+
+	p.client = paho.NewClient(opts)
+	p.client.Connect()
+
+	return &p, nil
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.topicPrefix + "/status"
+}
+
+func (p *Publisher) stateTopic(r *sensors.Reading) string {
+	return p.topicPrefix + "/" + slug(r.Name) + "/state"
+}
+
+// availabilityTopic is where the availability of a sensor is published; a sensor that stopped
+// sending readings is "offline".
+func (p *Publisher) availabilityTopic(name string) string {
+	return p.topicPrefix + "/" + slug(name) + "/availability"
+}
+
+// onConnect marks the probe as online and makes the next readings announce the sensors again,
+// in case the broker lost its retained messages.
+func (p *Publisher) onConnect(_ paho.Client) {
+	log.Print("connected to the MQTT broker")
+
+	p.mu.Lock()
+	p.announced = make(map[string]map[sensors.Quantity]bool)
+	p.mu.Unlock()
+
+	p.publish(p.statusTopic(), true, []byte(payloadOnline))
+}
+
+func (p *Publisher) publish(topic string, retained bool, payload []byte) {
+	token := p.client.Publish(topic, 1, retained, payload)
+	go func() {
+		if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+			log.Printf("error publishing to %s: %s", topic, token.Error())
+		}
+	}()
+}
+
+// Observe publishes a reading, announcing to Home Assistant the quantities not seen before.
+func (p *Publisher) Observe(r *sensors.Reading) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+
+	state := map[string]interface{}{rssiKey: r.RSSI}
+	for _, m := range r.Measurements {
+		if m.Unit == sensors.UnitBoolean {
+			state[string(m.Quantity)] = m.Bool()
+		} else {
+			state[string(m.Quantity)] = m.Value
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("error encoding the state of %s: %s", r.Name, err)
+		return
+	}
+
+	p.announce(r)
+	p.publish(p.stateTopic(r), false, payload)
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+type discovery struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	StateTopic        string         `json:"state_topic"`
+	ValueTemplate     string         `json:"value_template"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	StateClass        string         `json:"state_class,omitempty"`
+	EntityCategory    string         `json:"entity_category,omitempty"`
+	PayloadOn         string         `json:"payload_on,omitempty"`
+	PayloadOff        string         `json:"payload_off,omitempty"`
+	Availability      []availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode"`
+	Device            device         `json:"device"`
+}
+
+// announce publishes the discovery messages of the quantities of a reading that weren't announced
+// yet; Home Assistant creates a device for each sensor, with an entity for each quantity.
+func (p *Publisher) announce(r *sensors.Reading) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	announced, ok := p.announced[r.MAC]
+	if !ok {
+		announced = make(map[sensors.Quantity]bool)
+		p.announced[r.MAC] = announced
+		p.publish(p.availabilityTopic(r.Name), true, []byte(payloadOnline))
+	}
+
+	nodeID := strings.ToLower(strings.ReplaceAll(r.MAC, ":", ""))
+	dev := device{
+		Identifiers:  []string{"sensor-probe_" + nodeID},
+		Name:         r.Name,
+		Model:        r.Firmware,
+		Manufacturer: "sensor-probe",
+	}
+
+	// the entities are available while both the probe and the sensor are online.
+	avail := []availability{
+		{Topic: p.statusTopic()},
+		{Topic: p.availabilityTopic(r.Name)},
+	}
+
+	measurements := append([]sensors.Measurement{
+		{Quantity: rssiKey, Unit: sensors.UnitDBm},
+	}, r.Measurements...)
+
+	for _, m := range measurements {
+		if announced[m.Quantity] {
+			continue
+		}
+
+		info, ok := quantities[m.Quantity]
+		if !ok {
+			info.name = string(m.Quantity)
+		}
+		d := discovery{
+			Name:             info.name,
+			UniqueID:         fmt.Sprintf("sensor-probe_%s_%s", nodeID, m.Quantity),
+			StateTopic:       p.stateTopic(r),
+			ValueTemplate:    fmt.Sprintf("{{ value_json.%s }}", m.Quantity),
+			DeviceClass:      info.deviceClass,
+			Availability:     avail,
+			AvailabilityMode: "all",
+			Device:           dev,
+		}
+
+		component := "sensor"
+		switch {
+		case m.Quantity == rssiKey:
+			d.Name = "RSSI"
+			d.DeviceClass = "signal_strength"
+			d.UnitOfMeasurement = string(sensors.UnitDBm)
+			d.StateClass = "measurement"
+			d.EntityCategory = "diagnostic"
+		case m.Unit == sensors.UnitBoolean:
+			component = "binary_sensor"
+			d.ValueTemplate = fmt.Sprintf("{{ 'ON' if value_json.%s else 'OFF' }}", m.Quantity)
+			d.PayloadOn = "ON"
+			d.PayloadOff = "OFF"
+		default:
+			d.UnitOfMeasurement = string(m.Unit)
+			d.StateClass = "measurement"
+		}
+
+		payload, err := json.Marshal(d)
+		if err != nil {
+			log.Printf("error encoding the discovery message of %s: %s", r.Name, err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", p.discoveryPrefix, component, nodeID, m.Quantity)
+		p.publish(topic, true, payload)
+		announced[m.Quantity] = true
+	}
+}
+
+// ObserveStale publishes the availability of a sensor when it stops sending readings, or when it's
+// sending them again.
+func (p *Publisher) ObserveStale(s *sensors.Sensor, stale bool) {
+	if !p.client.IsConnectionOpen() {
+		return
+	}
+
+	payload := payloadOnline
+	if stale {
+		payload = payloadOffline
+	}
+	p.publish(p.availabilityTopic(s.Name), true, []byte(payload))
+}
+
+// Close marks the probe as offline and disconnects from the broker.
+func (p *Publisher) Close() {
+	if p.client.IsConnectionOpen() {
+		token := p.client.Publish(p.statusTopic(), 1, true, payloadOffline)
+		token.WaitTimeout(publishTimeout)
+	}
+	p.client.Disconnect(250)
+}
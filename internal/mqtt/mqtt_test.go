@@ -0,0 +1,45 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/config"
+)
+
+func TestSlug(t *testing.T) {
+	for name, want := range map[string]string{
+		"bedroom":          "bedroom",
+		"Living Room":      "living_room",
+		"living-room":      "living_room",
+		" Kid's room (2) ": "kid_s_room_2",
+	} {
+		if got := slug(name); got != want {
+			t.Errorf("slug(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	if err := checkNames([]string{"bedroom", "Living Room", "kitchen"}); err != nil {
+		t.Errorf("checkNames: %s", err)
+	}
+
+	for _, names := range [][]string{
+		{"Living Room", "bedroom", "living-room"},
+		{"bedroom", "BEDROOM"},
+		{"bedroom", "???"},
+	} {
+		if err := checkNames(names); err == nil {
+			t.Errorf("checkNames(%q) succeeded, want an error", names)
+		}
+	}
+}
+
+// The names are checked before connecting to the broker.
+func TestNewPublisherDuplicateNames(t *testing.T) {
+	p, err := NewPublisher(&config.MQTT{Broker: "tcp://127.0.0.1:1"}, []string{"Living Room", "living-room"})
+	if err == nil {
+		p.Close()
+		t.Fatal("NewPublisher succeeded, want an error")
+	}
+}
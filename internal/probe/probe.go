@@ -13,16 +13,29 @@ import (
 	"time"
 
 	"github.com/brutella/hc/accessory"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/piger/sensor-probe/internal/config"
 	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/metrics"
+	"github.com/piger/sensor-probe/internal/mqtt"
 	"github.com/piger/sensor-probe/internal/sensors"
-	"github.com/piger/sensor-probe/internal/sensors/mijia"
-	"github.com/piger/sensor-probe/internal/sensors/ruuvi"
+	_ "github.com/piger/sensor-probe/internal/sensors/aranet"
+	_ "github.com/piger/sensor-probe/internal/sensors/bthome"
+	_ "github.com/piger/sensor-probe/internal/sensors/generic"
+	_ "github.com/piger/sensor-probe/internal/sensors/govee"
+	_ "github.com/piger/sensor-probe/internal/sensors/inkbird"
+	_ "github.com/piger/sensor-probe/internal/sensors/mibeacon"
+	_ "github.com/piger/sensor-probe/internal/sensors/mijia"
+	_ "github.com/piger/sensor-probe/internal/sensors/ruuvi"
+	_ "github.com/piger/sensor-probe/internal/sensors/switchbot"
+	_ "github.com/piger/sensor-probe/internal/sensors/thermobeacon"
+	"github.com/piger/sensor-probe/internal/sink"
+	_ "github.com/piger/sensor-probe/internal/sink/influxdb"
+	"github.com/piger/sensor-probe/internal/sink/postgres"
+	"github.com/piger/sensor-probe/internal/sink/spool"
+	_ "github.com/piger/sensor-probe/internal/sink/sqlite"
 	"gitlab.com/jtaimisto/bluewalker/filter"
 	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
-	"golang.org/x/net/proxy"
 )
 
 // Probe is the structure that holds the state of this program.
@@ -54,6 +67,36 @@ func initRadio(device string) (*host.Host, error) {
 
 // Run is this program's main loop.
 func (p *Probe) Run() error {
+	sensorsDB := make(map[string]sensors.SensorUpdater)
+	var hkAccs []*accessory.Accessory
+
+	// IMPORTANT: sensors must always be added in the same order!
+	for i := range p.config.Sensors {
+		sensorConfig := &p.config.Sensors[i]
+		driver, err := sensors.Lookup(sensorConfig.Firmware)
+		if err != nil {
+			return fmt.Errorf("sensor %q: %w", sensorConfig.Name, err)
+		}
+		if driver.Validate != nil {
+			if err := driver.Validate(sensorConfig); err != nil {
+				return fmt.Errorf("sensor %q: %w", sensorConfig.Name, err)
+			}
+		}
+
+		id := uint64(i + 2)
+		log.Printf("adding sensor %s (%s) with ID %d", sensorConfig.Name, sensorConfig.MAC, id)
+
+		sensor, err := driver.New(sensorConfig, id)
+		if err != nil {
+			return fmt.Errorf("sensor %q: %w", sensorConfig.Name, err)
+		}
+		sensor.GetSensor().StoreInterval = p.config.StoreInterval(sensorConfig)
+		sensor.GetSensor().HomeKitInterval = p.config.HomeKitUpdateInterval(sensorConfig)
+		sensor.GetSensor().StaleTimeout = p.config.StaleAfter(sensorConfig)
+		sensorsDB[sensorConfig.MAC] = sensor
+		hkAccs = append(hkAccs, sensor.GetAccessory().Accessory)
+	}
+
 	hostRadio, err := initRadio(p.device)
 	if err != nil {
 		return err
@@ -62,52 +105,81 @@ func (p *Probe) Run() error {
 
 	ctx, stopCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
-	pgConfig, err := pgxpool.ParseConfig(p.config.DBConfig)
+	sinks, err := openSinks(ctx, p.config)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		for _, s := range sinks {
+			if err := s.Close(); err != nil {
+				log.Printf("error closing sink: %s", err)
+			}
+		}
+	}()
+
+	// the consumers of every new reading, besides HomeKit, and of the "sensor silent" events.
+	var observers []func(*sensors.Reading)
+	var staleObservers []func(*sensors.Sensor, bool)
+	var onInvalid func(*sensors.Sensor, string)
 
-	socksProxy := os.Getenv("SOCKS_PROXY")
-	if socksProxy != "" {
-		dialer, err := proxy.SOCKS5("tcp", socksProxy, nil, proxy.Direct)
+	if p.config.Metrics.Listen != "" {
+		exporter := metrics.NewExporter()
+		metricsListener, err := net.Listen("tcp", p.config.Metrics.Listen)
 		if err != nil {
-			return err
+			return fmt.Errorf("starting the metrics listener: %w", err)
 		}
+		log.Printf("exporting Prometheus metrics on %s/metrics", metricsListener.Addr())
 
-		if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
-			pgConfig.ConnConfig.DialFunc = contextDialer.DialContext
-		} else {
-			return errors.New("failed type assertion into ContextDialer")
+		go func() {
+			if err := exporter.Serve(metricsListener); err != nil {
+				log.Printf("error from metrics HTTP server: %s", err)
+			}
+		}()
+		observers = append(observers, exporter.Observe)
+		staleObservers = append(staleObservers, exporter.ObserveStale)
+		onInvalid = exporter.ObserveInvalid
+
+		for _, s := range sinks {
+			if sp, ok := s.(*spool.Spool); ok {
+				exporter.AddSpool(sp.Name(), sp.Stats)
+			}
 		}
-
-		log.Printf("Using SOCKS5 proxy at %s", socksProxy)
 	}
 
-	pool, err := pgxpool.ConnectConfig(ctx, pgConfig)
-	if err != nil {
-		return err
+	if p.config.MQTT.Broker != "" {
+		log.Printf("publishing the readings to the MQTT broker %s", p.config.MQTT.Broker)
+		var names []string
+		for _, sc := range p.config.Sensors {
+			names = append(names, sc.Name)
+		}
+		publisher, err := mqtt.NewPublisher(&p.config.MQTT, names)
+		if err != nil {
+			return fmt.Errorf("starting the MQTT publisher: %w", err)
+		}
+		defer publisher.Close()
+		observers = append(observers, publisher.Observe)
+		staleObservers = append(staleObservers, publisher.ObserveStale)
 	}
-	defer pool.Close()
-
-	sensorsDB := make(map[string]sensors.SensorUpdater)
-	var hkAccs []*accessory.Accessory
 
-	// IMPORTANT: sensors must always be added in the same order!
-	for i, sensorConfig := range p.config.Sensors {
-		id := uint64(i + 2)
-		log.Printf("adding sensor %s (%s) with ID %d", sensorConfig.Name, sensorConfig.MAC, id)
-
-		var sensor sensors.SensorUpdater
-		if sensorConfig.Firmware == "custom" {
-			sensor = mijia.NewMijiaSensor(&sensorConfig, id)
-		} else if sensorConfig.Firmware == "ruuviv5" {
-			sensor = ruuvi.NewRuuviSensor(&sensorConfig, id)
-		} else {
-			return fmt.Errorf("sensor of type %s is unsupported", sensorConfig.Firmware)
+	for _, sensor := range sensorsDB {
+		sensor.GetSensor().OnReading = func(r *sensors.Reading) {
+			for _, observe := range observers {
+				observe(r)
+			}
 		}
-
-		sensorsDB[sensorConfig.MAC] = sensor
-		hkAccs = append(hkAccs, sensor.GetAccessory().Accessory)
+		sensor.GetSensor().OnStale = func(s *sensors.Sensor, stale bool) {
+			if stale && s.LastReading == nil {
+				log.Printf("sensor %s silent: no readings since the start", s.Name)
+			} else if stale {
+				log.Printf("sensor %s silent: no readings since %s", s.Name, s.LastReading.Time.Format(time.RFC3339))
+			} else {
+				log.Printf("sensor %s is sending readings again", s.Name)
+			}
+			for _, observe := range staleObservers {
+				observe(s, stale)
+			}
+		}
+		sensor.GetSensor().OnInvalid = onInvalid
 	}
 
 	hkTransport, err := homekit.SetupHomeKit(&p.config.HomeKit, hkAccs)
@@ -147,9 +219,17 @@ func (p *Probe) Run() error {
 		return fmt.Errorf("starting scan: %w", err)
 	}
 
-	tick := time.NewTicker(sensors.DatabaseUpdateInterval)
+	tickInterval := storeTick(sensorsDB)
+	tick := time.NewTicker(tickInterval)
 	defer tick.Stop()
 
+	// the first readings are stored after a full interval.
+	now := time.Now()
+	for _, sensor := range sensorsDB {
+		sensor.GetSensor().LastUpdateDB = now
+		sensor.GetSensor().Started = now
+	}
+
 Loop:
 	for {
 		select {
@@ -165,8 +245,29 @@ Loop:
 
 		case ts := <-tick.C:
 			for _, sensor := range sensorsDB {
-				if err := sensor.Push(ctx, pool, ts); err != nil {
-					log.Printf("error sending metrics from %s: %s", sensor.GetName(), err)
+				point, err := storePoint(sensor.GetSensor(), ts, tickInterval)
+				if err != nil {
+					if len(sinks) > 0 {
+						log.Printf("error sending metrics from %s: %s", sensor.GetName(), err)
+					}
+					continue
+				}
+				if point == nil {
+					continue
+				}
+
+				for _, s := range sinks {
+					if err := s.Write(ctx, *point); err != nil {
+						log.Printf("error sending metrics from %s: %s", sensor.GetName(), err)
+					}
+				}
+			}
+
+			for _, s := range sinks {
+				if f, ok := s.(sink.Flusher); ok {
+					if err := f.Flush(ctx); err != nil {
+						log.Printf("error flushing metrics: %s", err)
+					}
 				}
 			}
 
@@ -195,29 +296,167 @@ Loop:
 	return nil
 }
 
+// storeTick returns the interval of the storage ticker: the greatest common divisor of the storage
+// intervals of the sensors, so that each sensor can be stored on time.
+func storeTick(sensorsDB map[string]sensors.SensorUpdater) time.Duration {
+	var tick time.Duration
+	for _, sensor := range sensorsDB {
+		a, b := tick, sensor.GetSensor().StoreInterval
+		for b != 0 {
+			a, b = b, a%b
+		}
+		tick = a
+	}
+
+	if tick < time.Second {
+		tick = time.Second
+	}
+	return tick
+}
+
+// storeDue tells whether a sensor must be stored at a tick; half a tick of tolerance makes up for
+// the ticks delivered late.
+func storeDue(sensor *sensors.Sensor, ts time.Time, tick time.Duration) bool {
+	return ts.Sub(sensor.LastUpdateDB)+tick/2 >= sensor.StoreInterval
+}
+
+// errNoReading is returned by storePoint for the sensors that weren't heard yet.
+var errNoReading = errors.New("no last data")
+
+// storePoint returns the point to be stored for a sensor at a tick, or nil if the sensor is not due
+// or is silent, or if no reading was received since the last store.
+func storePoint(sensor *sensors.Sensor, ts time.Time, tick time.Duration) (*sink.Point, error) {
+	// the readings of the stale sensors aren't stored again.
+	if sensor.CheckStale(ts) || !storeDue(sensor, ts, tick) {
+		return nil, nil
+	}
+	sensor.LastUpdateDB = ts
+
+	reading := sensor.LastReading
+	if reading == nil {
+		return nil, errNoReading
+	}
+	if reading == sensor.StoredReading {
+		return nil, nil
+	}
+	sensor.StoredReading = reading
+
+	return &sink.Point{
+		Time:    reading.Time,
+		Sensor:  sensor,
+		Reading: reading,
+		Stats:   sensor.Stats.Take(),
+	}, nil
+}
+
+// openSinks opens the storage backends; "dbconfig" is a shorthand for a "postgres" sink.
+func openSinks(ctx context.Context, cfg *config.Config) ([]sink.Sink, error) {
+	sinkConfigs := cfg.Sinks
+	if cfg.DBConfig != "" {
+		sinkConfigs = append([]config.SinkConfig{{Type: postgres.Type, DSN: cfg.DBConfig}}, sinkConfigs...)
+	}
+
+	tables, err := sensorTables(cfg.Sensors)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []sink.Sink
+	for i := range sinkConfigs {
+		sinkConfigs[i].Tables = tables
+		s, err := openSink(ctx, &sinkConfigs[i])
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("sink %q: %w", sinkConfigs[i].Type, err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	if len(sinks) == 0 {
+		log.Print("no sinks configured, the readings won't be stored")
+	}
+	return sinks, nil
+}
+
+// sensorTables returns the tables written by the sensors, each with the table of doc/schema.sql
+// used by the driver of the first sensor writing to it.
+func sensorTables(sensorConfigs []config.SensorConfig) ([]config.Table, error) {
+	var tables []config.Table
+	seen := make(map[string]bool)
+
+	for i := range sensorConfigs {
+		sensor := &sensorConfigs[i]
+		if sensor.DBTable == "" || seen[sensor.DBTable] {
+			continue
+		}
+		driver, err := sensors.Lookup(sensor.Firmware)
+		if err != nil {
+			return nil, err
+		}
+
+		tables = append(tables, config.Table{Name: sensor.DBTable, Schema: driver.SchemaTable()})
+		seen[sensor.DBTable] = true
+	}
+
+	return tables, nil
+}
+
+// openSink opens a storage backend, wrapping it in a spool if "spool_dir" is set.
+func openSink(ctx context.Context, cfg *config.SinkConfig) (sink.Sink, error) {
+	s, err := sink.Open(ctx, cfg)
+	if err != nil || cfg.SpoolDir == "" {
+		return s, err
+	}
+
+	sp, err := spool.New(s, cfg.Type, cfg.SpoolDir, cfg.SpoolMaxSize)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return sp, nil
+}
+
 // buildFilters builds a filter set for bluewalker to only capture events sent from devices
-// having the specified MAC addresses.
-func buildFilters(sensors []config.SensorConfig) ([]filter.AdFilter, error) {
-	addrFilters := make([]filter.AdFilter, len(sensors))
-	for i, sensor := range sensors {
+// having the specified MAC addresses and carrying data in a format understood by their drivers.
+func buildFilters(sensorConfigs []config.SensorConfig) ([]filter.AdFilter, error) {
+	addrFilters := make([]filter.AdFilter, len(sensorConfigs))
+	var dataFilters []filter.AdFilter
+	seen := make(map[string]bool)
+
+	for i := range sensorConfigs {
+		sensor := &sensorConfigs[i]
+		driver, err := sensors.Lookup(sensor.Firmware)
+		if err != nil {
+			return nil, err
+		}
+
+		atype, dataFilter, err := driver.FilterFor(sensor)
+		if err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", sensor.Name, err)
+		}
+
 		baddr, err := hci.BtAddressFromString(sensor.MAC)
 		if err != nil {
 			return nil, fmt.Errorf("parsing MAC address %q: %w", sensor.MAC, err)
 		}
+		baddr.Atype = atype
+		addrFilters[i] = filter.ByAddress(baddr)
 
-		// hack to support BT random addresses
-		if sensor.Firmware == "ruuviv5" {
-			baddr.Atype = hci.LeRandomAddress
+		// the driver filters match on the vendor, service data, local name or payload length;
+		// the filters described in the sensor configuration can't be shared.
+		if driver.SensorFilter != nil {
+			dataFilters = append(dataFilters, dataFilter)
+		} else if !seen[driver.Firmware] {
+			dataFilters = append(dataFilters, dataFilter)
+			seen[driver.Firmware] = true
 		}
-		addrFilters[i] = filter.ByAddress(baddr)
 	}
 
 	filters := []filter.AdFilter{
 		filter.Any(addrFilters),
-		filter.Any([]filter.AdFilter{
-			filter.ByVendor([]byte{0x99, 0x04}),
-			filter.ByAdData(hci.AdServiceData, []byte{0x1a, 0x18}),
-		}),
+		filter.Any(dataFilters),
 	}
 
 	return filters, nil
@@ -0,0 +1,194 @@
+package probe
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+type fakeSensor struct {
+	*sensors.Sensor
+}
+
+func (f fakeSensor) Update(*host.ScanReport) error {
+	return nil
+}
+
+// sensorsDB returns the sensors of a configuration, with their storage intervals.
+func sensorsDB(cfg *config.Config) map[string]sensors.SensorUpdater {
+	db := make(map[string]sensors.SensorUpdater)
+	for i := range cfg.Sensors {
+		sc := &cfg.Sensors[i]
+		s := &sensors.Sensor{Name: sc.Name, StoreInterval: cfg.StoreInterval(sc)}
+		db[sc.Name] = fakeSensor{s}
+	}
+	return db
+}
+
+func testConfig(global string, intervals ...string) *config.Config {
+	var cfg config.Config
+	if err := cfg.Interval.UnmarshalText([]byte(global)); err != nil {
+		panic(err)
+	}
+	for i, interval := range intervals {
+		sc := config.SensorConfig{Name: fmt.Sprintf("sensor%d", i)}
+		if interval != "" {
+			if err := sc.Interval.UnmarshalText([]byte(interval)); err != nil {
+				panic(err)
+			}
+		}
+		cfg.Sensors = append(cfg.Sensors, sc)
+	}
+	return &cfg
+}
+
+func TestStoreTick(t *testing.T) {
+	tests := []struct {
+		global    string
+		intervals []string
+		want      time.Duration
+	}{
+		{"5m", []string{"", ""}, 5 * time.Minute},
+		{"5m", []string{"30s", ""}, 30 * time.Second},
+		{"5m", []string{"45s", "2m"}, 15 * time.Second},
+		{"1m", []string{"", "90s"}, 30 * time.Second},
+		{"10m", []string{"7m", "3m"}, time.Minute},
+		{"5m", []string{"1500ms", "1s"}, time.Second}, // never less than a second
+		{"5m", nil, time.Second},
+	}
+
+	for _, tt := range tests {
+		got := storeTick(sensorsDB(testConfig(tt.global, tt.intervals...)))
+		if got != tt.want {
+			t.Errorf("storeTick(%s, %v) = %s, want %s", tt.global, tt.intervals, got, tt.want)
+		}
+	}
+}
+
+// TestStoreDue runs the storage loop for an hour, with some of the ticks delivered late, and counts
+// the readings stored for each sensor.
+func TestStoreDue(t *testing.T) {
+	tests := []struct {
+		global    string
+		intervals []string
+		want      []int // the number of stores of each sensor
+	}{
+		{"5m", []string{"", ""}, []int{12, 12}},
+		{"5m", []string{"30s", ""}, []int{120, 12}},
+		{"5m", []string{"45s", "2m"}, []int{80, 30}},
+		{"1m", []string{"", "90s", "10m"}, []int{60, 40, 6}},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(tt.global, tt.intervals...)
+		db := sensorsDB(cfg)
+		tick := storeTick(db)
+
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for _, sensor := range db {
+			sensor.GetSensor().LastUpdateDB = start
+		}
+
+		stores := make(map[string]int)
+		for n := 1; time.Duration(n)*tick <= time.Hour; n++ {
+			ts := start.Add(time.Duration(n) * tick)
+			// one tick out of three arrives a bit late.
+			if n%3 == 0 {
+				ts = ts.Add(tick / 5)
+			}
+
+			for name, sensor := range db {
+				if storeDue(sensor.GetSensor(), ts, tick) {
+					sensor.GetSensor().LastUpdateDB = ts
+					stores[name]++
+				}
+			}
+		}
+
+		for i, want := range tt.want {
+			name := cfg.Sensors[i].Name
+			if stores[name] != want {
+				t.Errorf("%s %v: %s (every %s) stored %d times in an hour, want %d",
+					tt.global, tt.intervals, name, db[name].GetSensor().StoreInterval, stores[name], want)
+			}
+		}
+	}
+}
+
+func TestStorePoint(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tick := time.Minute
+	s := sensors.NewSensor(&config.SensorConfig{Name: "bedroom"}, homekit.NewTemperatureHumiditySensor(accessory.Info{Name: "bedroom"}))
+	s.StoreInterval = 5 * time.Minute
+	s.StaleTimeout = 30 * time.Minute
+	s.LastUpdateDB, s.Started = start, start
+
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	record := func(d time.Duration, v float64) *sensors.Reading {
+		r := &sensors.Reading{Time: at(d)}
+		r.Add(sensors.Temperature, sensors.UnitCelsius, v)
+		s.Record(r)
+		return r
+	}
+
+	// nothing was received yet.
+	if p, err := storePoint(s, at(5*time.Minute), tick); p != nil || err != errNoReading {
+		t.Fatalf("storePoint without readings = %+v, %v", p, err)
+	}
+
+	// the point carries the time of the reading, not the time of the tick.
+	record(6*time.Minute, 20)
+	r := record(7*time.Minute, 21)
+	if p, _ := storePoint(s, at(8*time.Minute), tick); p != nil {
+		t.Fatalf("storePoint before the interval = %+v", p)
+	}
+	p, err := storePoint(s, at(10*time.Minute), tick)
+	if err != nil || p == nil {
+		t.Fatalf("storePoint = %+v, %v", p, err)
+	}
+	if p.Reading != r || !p.Time.Equal(r.Time) {
+		t.Errorf("stored the reading of %s at %s, want the last one at %s", p.Reading.Time, p.Time, r.Time)
+	}
+	if len(p.Stats) != 1 || p.Stats[0].Count != 2 {
+		t.Errorf("stats = %+v, want 2 temperature samples", p.Stats)
+	}
+
+	// the same reading isn't stored twice.
+	if p, err := storePoint(s, at(15*time.Minute), tick); p != nil || err != nil {
+		t.Errorf("storePoint without a new reading = %+v, %v", p, err)
+	}
+
+	record(16*time.Minute, 22)
+	if p, _ := storePoint(s, at(20*time.Minute), tick); p == nil || !p.Time.Equal(at(16*time.Minute)) {
+		t.Errorf("storePoint after a new reading = %+v", p)
+	}
+
+	// a silent sensor isn't stored.
+	if p, err := storePoint(s, at(50*time.Minute), tick); p != nil || err != nil || !s.Stale {
+		t.Errorf("storePoint of a silent sensor = %+v, %v (stale: %v)", p, err, s.Stale)
+	}
+}
+
+func TestStorePointNeverHeard(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := sensors.NewSensor(&config.SensorConfig{Name: "bedroom"}, homekit.NewTemperatureHumiditySensor(accessory.Info{Name: "bedroom"}))
+	s.StoreInterval = 5 * time.Minute
+	s.StaleTimeout = 30 * time.Minute
+	s.LastUpdateDB, s.Started = start, start
+
+	var stale []bool
+	s.OnStale = func(_ *sensors.Sensor, v bool) { stale = append(stale, v) }
+
+	for d := 5 * time.Minute; d <= time.Hour; d += 5 * time.Minute {
+		storePoint(s, start.Add(d), time.Minute)
+	}
+	if len(stale) != 1 || !stale[0] {
+		t.Errorf("OnStale events %v, want the sensor to be silent once", stale)
+	}
+}
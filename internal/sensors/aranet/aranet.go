@@ -0,0 +1,169 @@
+// Aranet4 CO2 monitor, with the "smart home integration" enabled
+// https://github.com/Anrijs/Aranet4-Python
+
+package aranet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Manufacturer ID: SAF Tehnika.
+const UUID = 0x0702
+
+// Firmware is the name of the Aranet4 driver in the configuration file.
+const Firmware = "aranet4"
+
+// flagIntegration is set in the flags byte when the smart home integration is enabled; without
+// it the device doesn't broadcast its measurements.
+const flagIntegration = 1 << 5
+
+// Status colors of the CO2 level.
+const (
+	StatusGreen = 1
+	StatusAmber = 2
+	StatusRed   = 3
+)
+
+func init() {
+	// Aranet devices use a random static Bluetooth address.
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LeRandomAddress,
+		Filter:      filter.ByVendor([]byte{0x02, 0x07}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewAranetSensor(config, id), nil
+		},
+	})
+}
+
+// all the fields are little endian.
+type payload struct {
+	UUID        uint16 // 0x0702, manufacturer ID
+	Flags       uint8
+	Version     [3]uint8
+	Unknown     [4]uint8
+	CO2         uint16 // ppm
+	Temperature uint16 // 1/20 °C
+	Pressure    uint16 // 0.1 hPa
+	Humidity    uint8
+	Battery     uint8
+	Status      uint8
+	Interval    uint16 // seconds
+	Ago         uint16 // seconds since the last measurement
+	Counter     uint8
+}
+
+type Data struct {
+	CO2         uint16
+	Temperature float32
+	Pressure    int // Pa
+	Humidity    float32
+	Battery     uint16
+	Status      uint8
+}
+
+func parseMessage(b []byte) (*Data, error) {
+	if len(b) < 3 {
+		return nil, errors.New("aranet message too short")
+	}
+	if b[2]&flagIntegration == 0 {
+		return nil, errors.New("the smart home integration is disabled")
+	}
+
+	var p payload
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &p); err != nil {
+		return nil, err
+	}
+
+	data := Data{
+		CO2:         p.CO2,
+		Temperature: float32(p.Temperature) / 20,
+		Pressure:    int(p.Pressure) * 10,
+		Humidity:    float32(p.Humidity),
+		Battery:     uint16(p.Battery),
+		Status:      p.Status,
+	}
+	return &data, nil
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdManufacturerSpecific && len(r.Data) >= 2 && binary.LittleEndian.Uint16(r.Data) == UUID
+}
+
+type AranetSensor struct {
+	*sensors.Sensor
+	AirQuality *homekit.AirQualitySensor
+}
+
+func NewAranetSensor(config *config.SensorConfig, id uint64) *AranetSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Aranet4",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "SAF Tehnika",
+		ID:           id,
+	}
+
+	acc := homekit.NewAirQualitySensor(info)
+	s := sensors.NewSensor(config, acc.TemperatureHumiditySensor)
+
+	as := AranetSensor{
+		Sensor:     s,
+		AirQuality: acc,
+	}
+	as.UpdateAccessory = as.updateAccessory
+	return &as
+}
+
+func (a *AranetSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := a.handleBroadcast(report, ads); err != nil {
+				log.Printf("%s: %s", a.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *AranetSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	data, err := parseMessage(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	r := a.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	r.Add(sensors.Pressure, sensors.UnitPascal, float64(data.Pressure))
+	r.Add(sensors.CO2, sensors.UnitPPM, float64(data.CO2))
+	r.Add(sensors.CO2Status, sensors.UnitNone, float64(data.Status))
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	a.Record(r)
+
+	return nil
+}
+
+// updateAccessory also sends the CO2 level to HomeKit, as abnormal when the device shows it red.
+func (a *AranetSensor) updateAccessory(r *sensors.Reading) {
+	a.UpdateTemperatureHumidity(r)
+
+	co2, ok := r.Get(sensors.CO2)
+	if !ok {
+		return
+	}
+	status, _ := r.Get(sensors.CO2Status)
+	a.AirQuality.SetCarbonDioxide(co2.Value, status.Value == StatusRed)
+}
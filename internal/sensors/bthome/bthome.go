@@ -0,0 +1,357 @@
+// BTHome v2 advertisements, sent by the pvvx firmware, Shelly BLU devices and many DIY sensors.
+// https://bthome.io/format/
+
+package bthome
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/ccm"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Service UUID: Allterco Robotics ltd (BTHome).
+const UUID = 0xfcd2
+
+// Firmware is the name of the BTHome driver in the configuration file.
+const Firmware = "bthome"
+
+// Device information bits.
+const (
+	infoEncrypted = 1 << 0
+	infoVersion   = 0xe0
+)
+
+// keySize is the size of the encryption key.
+const keySize = 16
+
+// Object IDs of the measurements stored by this driver.
+const (
+	objPacketID      = 0x00
+	objBattery       = 0x01
+	objTemperature   = 0x02
+	objHumidity      = 0x03
+	objPressure      = 0x04
+	objIlluminance   = 0x05
+	objVoltage       = 0x0c
+	objCO2           = 0x12
+	objMotion        = 0x21
+	objWindow        = 0x2d
+	objHumidity8     = 0x2e
+	objButton        = 0x3a
+	objTemperature01 = 0x45
+	objVoltage01     = 0x4a
+	objText          = 0x53
+	objRaw           = 0x54
+)
+
+// objectSizes maps every object ID defined by the BTHome v2 specification to the size of its
+// value, so that the objects that are not stored can be skipped; 0x53 and 0x54 have a variable
+// size, stored in the first byte of their value.
+var objectSizes = map[byte]int{
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x04: 3, 0x05: 3, 0x06: 2, 0x07: 2,
+	0x08: 2, 0x09: 1, 0x0a: 3, 0x0b: 3, 0x0c: 2, 0x0d: 2, 0x0e: 2, 0x0f: 1,
+	0x10: 1, 0x11: 1, 0x12: 2, 0x13: 2, 0x14: 2, 0x15: 1, 0x16: 1, 0x17: 1,
+	0x18: 1, 0x19: 1, 0x1a: 1, 0x1b: 1, 0x1c: 1, 0x1d: 1, 0x1e: 1, 0x1f: 1,
+	0x20: 1, 0x21: 1, 0x22: 1, 0x23: 1, 0x24: 1, 0x25: 1, 0x26: 1, 0x27: 1,
+	0x28: 1, 0x29: 1, 0x2a: 1, 0x2b: 1, 0x2c: 1, 0x2d: 1, 0x2e: 1, 0x2f: 1,
+	0x3a: 1, 0x3c: 2, 0x3d: 2, 0x3e: 4, 0x3f: 2, 0x40: 2, 0x41: 2, 0x42: 3,
+	0x43: 2, 0x44: 2, 0x45: 2, 0x46: 1, 0x47: 2, 0x48: 2, 0x49: 2, 0x4a: 2,
+	0x4b: 3, 0x4c: 4, 0x4d: 4, 0x4e: 4, 0x4f: 4, 0x50: 4, 0x51: 2, 0x52: 2,
+	0x55: 4, 0x56: 2, 0x57: 1, 0x58: 1, 0x59: 1, 0x5a: 2, 0x5b: 4, 0x5c: 4,
+	0x5d: 2, 0x5e: 2, 0x5f: 2, 0x60: 1, 0xf0: 2, 0xf1: 4, 0xf2: 3,
+}
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter:      filter.ByAdData(hci.AdServiceData, []byte{0xd2, 0xfc}),
+		Validate:    validateConfig,
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewBTHomeSensor(config, id)
+		},
+		Table: "home_bthome",
+	})
+}
+
+func validateConfig(sc *config.SensorConfig) error {
+	_, err := decodeKey(sc.BindKey)
+	return err
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bindkey: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid bindkey: must be %d bytes long, not %d", keySize, len(key))
+	}
+
+	return key, nil
+}
+
+// Object is a single BTHome object.
+type Object struct {
+	ID    byte
+	Value []byte
+}
+
+// ParseObjects splits a BTHome objects payload into its objects. Parsing stops at the first
+// object ID not defined by the specification, since its size is unknown: the objects decoded up
+// to that point are returned, and unknown holds the rest of the payload, starting with that ID.
+func ParseObjects(b []byte) (objects []Object, unknown []byte, err error) {
+	for len(b) > 0 {
+		id := b[0]
+
+		size, ok := objectSizes[id]
+		if !ok {
+			if id != objText && id != objRaw {
+				return objects, b, nil
+			}
+			if len(b) < 2 {
+				return objects, nil, fmt.Errorf("truncated BTHome object 0x%02x", id)
+			}
+			size = int(b[1])
+			b = b[1:]
+		}
+		b = b[1:]
+
+		if len(b) < size {
+			return objects, nil, fmt.Errorf("truncated BTHome object 0x%02x", id)
+		}
+		objects = append(objects, Object{ID: id, Value: b[:size]})
+		b = b[size:]
+	}
+	return objects, nil, nil
+}
+
+// Decrypt decrypts the payload of an encrypted BTHome frame: b is the whole service data and
+// mac the sensor MAC address in the usual (big endian) order.
+func Decrypt(b, mac, key []byte) ([]byte, error) {
+	// UUID, device information, at least one byte of payload, counter and tag.
+	if len(b) < 3+1+4+4 {
+		return nil, errors.New("encrypted BTHome frame too short")
+	}
+
+	n := len(b)
+	counter := b[n-8 : n-4]
+	nonce := make([]byte, 0, 13)
+	nonce = append(nonce, mac...)
+	nonce = append(nonce, b[0:3]...) // UUID and device information
+	nonce = append(nonce, counter...)
+
+	ciphertext := make([]byte, 0, n-3-4)
+	ciphertext = append(ciphertext, b[3:n-8]...)
+	ciphertext = append(ciphertext, b[n-4:]...)
+
+	return ccm.Open(key, nonce, ciphertext, nil, 4)
+}
+
+// Data holds the latest values received from a sensor; the fields are nil until the sensor
+// sends the corresponding object.
+type Data struct {
+	PacketID    *uint8
+	Temperature *float32
+	Humidity    *float32
+	Pressure    *float32 // hPa
+	Illuminance *float32 // lux
+	Battery     *uint16
+	Voltage     *float32 // V
+	CO2         *uint16  // ppm
+	Motion      *bool
+	Window      *bool
+	Button      *uint8 // button event of the last frame
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// apply stores the value of an object into d; the objects that are not stored are ignored.
+func (d *Data) apply(obj Object) {
+	v := obj.Value
+
+	switch obj.ID {
+	case objPacketID:
+		d.PacketID = ptr(v[0])
+	case objBattery:
+		d.Battery = ptr(uint16(v[0]))
+	case objTemperature:
+		d.Temperature = ptr(float32(int16(binary.LittleEndian.Uint16(v))) * 0.01)
+	case objTemperature01:
+		d.Temperature = ptr(float32(int16(binary.LittleEndian.Uint16(v))) * 0.1)
+	case objHumidity:
+		d.Humidity = ptr(float32(binary.LittleEndian.Uint16(v)) * 0.01)
+	case objHumidity8:
+		d.Humidity = ptr(float32(v[0]))
+	case objPressure:
+		d.Pressure = ptr(float32(uint24(v)) * 0.01)
+	case objIlluminance:
+		d.Illuminance = ptr(float32(uint24(v)) * 0.01)
+	case objVoltage:
+		d.Voltage = ptr(float32(binary.LittleEndian.Uint16(v)) * 0.001)
+	case objVoltage01:
+		d.Voltage = ptr(float32(binary.LittleEndian.Uint16(v)) * 0.1)
+	case objCO2:
+		d.CO2 = ptr(binary.LittleEndian.Uint16(v))
+	case objMotion:
+		d.Motion = ptr(v[0] != 0)
+	case objWindow:
+		d.Window = ptr(v[0] != 0)
+	case objButton:
+		d.Button = ptr(v[0])
+	}
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdServiceData && len(r.Data) >= 3 && binary.LittleEndian.Uint16(r.Data) == UUID
+}
+
+type BTHomeSensor struct {
+	*sensors.Sensor
+
+	// the objects received so far; some sensors send them in separate advertisements.
+	data *Data
+
+	key []byte
+	mac []byte
+
+	// the unknown object IDs received so far, logged only once.
+	unknown map[byte]bool
+}
+
+func NewBTHomeSensor(config *config.SensorConfig, id uint64) (*BTHomeSensor, error) {
+	key, err := decodeKey(config.BindKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := net.ParseMAC(config.MAC)
+	if err != nil {
+		return nil, err
+	}
+
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "BTHome sensor",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "BTHome",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	bs := BTHomeSensor{
+		Sensor:  s,
+		key:     key,
+		mac:     mac,
+		unknown: make(map[byte]bool),
+	}
+	return &bs, nil
+}
+
+func (bs *BTHomeSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := bs.handleBroadcast(report, ads); err != nil {
+				log.Printf("%s: %s", bs.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (bs *BTHomeSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	info := msg.Data[2]
+	if version := (info & infoVersion) >> 5; version != 2 {
+		return fmt.Errorf("unsupported BTHome version: %d", version)
+	}
+
+	payload := msg.Data[3:]
+	if info&infoEncrypted != 0 {
+		if bs.key == nil {
+			return errors.New("encrypted BTHome frame but no bindkey configured")
+		}
+
+		var err error
+		payload, err = Decrypt(msg.Data, bs.mac, bs.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	objects, unknown, err := ParseObjects(payload)
+	if err != nil {
+		return err
+	}
+	// the objects after an unknown one are lost, but the ones before it are still good.
+	if len(unknown) > 0 && !bs.unknown[unknown[0]] {
+		bs.unknown[unknown[0]] = true
+		log.Printf("%s: skipping the unknown BTHome object ID 0x%02x and the following objects", bs.Name, unknown[0])
+	}
+
+	if bs.data == nil {
+		bs.data = &Data{}
+	}
+
+	// the sensors repeat each advertisement several times.
+	lastPacketID := bs.data.PacketID
+	for _, obj := range objects {
+		if obj.ID == objPacketID && lastPacketID != nil && *lastPacketID == obj.Value[0] {
+			return nil
+		}
+	}
+
+	// the data of this frame alone, for the statistics.
+	var fresh Data
+	for _, obj := range objects {
+		bs.data.apply(obj)
+		fresh.apply(obj)
+	}
+	// a button press is an event, not a state: it's only reported by the frame that carries it.
+	bs.data.Button = fresh.Button
+
+	r := bs.NewReading(report)
+	bs.data.addTo(r)
+	sample := bs.NewReading(report)
+	fresh.addTo(sample)
+	bs.RecordMerged(r, sample)
+
+	return nil
+}
+
+// addTo adds the measurements to a reading.
+func (d *Data) addTo(r *sensors.Reading) {
+	sensors.AddOptional(r, sensors.Temperature, sensors.UnitCelsius, d.Temperature)
+	sensors.AddOptional(r, sensors.Humidity, sensors.UnitPercent, d.Humidity)
+	sensors.AddOptional(r, sensors.Pressure, sensors.UnitHectoPascal, d.Pressure)
+	sensors.AddOptional(r, sensors.Illuminance, sensors.UnitLux, d.Illuminance)
+	sensors.AddOptional(r, sensors.Battery, sensors.UnitPercent, d.Battery)
+	sensors.AddOptional(r, sensors.Voltage, sensors.UnitVolt, d.Voltage)
+	sensors.AddOptional(r, sensors.CO2, sensors.UnitPPM, d.CO2)
+	sensors.AddOptionalBool(r, sensors.Motion, d.Motion)
+	sensors.AddOptionalBool(r, sensors.Window, d.Window)
+	sensors.AddOptional(r, sensors.Button, sensors.UnitNone, d.Button)
+}
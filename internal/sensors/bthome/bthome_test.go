@@ -0,0 +1,257 @@
+package bthome
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/ccm"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseObjects(t *testing.T) {
+	// the examples of https://bthome.io/format/
+	tests := []struct {
+		name    string
+		payload string
+		want    []Object
+		unknown string
+	}{
+		{
+			name:    "temperature and humidity",
+			payload: "02ca0903bf13",
+			want:    []Object{{ID: objTemperature, Value: []byte{0xca, 0x09}}, {ID: objHumidity, Value: []byte{0xbf, 0x13}}},
+		},
+		{
+			name:    "packet ID and battery",
+			payload: "00090161",
+			want:    []Object{{ID: objPacketID, Value: []byte{0x09}}, {ID: objBattery, Value: []byte{0x61}}},
+		},
+		{
+			name:    "objects not stored",
+			payload: "0a138a14" + "3e29d60000" + "2e23",
+			want: []Object{
+				{ID: 0x0a, Value: []byte{0x13, 0x8a, 0x14}},
+				{ID: 0x3e, Value: []byte{0x29, 0xd6, 0x00, 0x00}},
+				{ID: objHumidity8, Value: []byte{0x23}},
+			},
+		},
+		{
+			name:    "text",
+			payload: "530c48656c6c6f20576f726c6421" + "0161",
+			want: []Object{
+				{ID: objText, Value: []byte("Hello World!")},
+				{ID: objBattery, Value: []byte{0x61}},
+			},
+		},
+		{
+			name:    "unknown object ID",
+			payload: "02ca09" + "fe0102" + "0161",
+			want:    []Object{{ID: objTemperature, Value: []byte{0xca, 0x09}}},
+			unknown: "fe01020161",
+		},
+		{
+			name:    "unknown object ID first",
+			payload: "700102",
+			unknown: "700102",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, unknown, err := ParseObjects(unhex(t, tt.payload))
+			if err != nil {
+				t.Fatalf("ParseObjects: %s", err)
+			}
+			if len(objects) != len(tt.want) {
+				t.Fatalf("got %d objects, want %d", len(objects), len(tt.want))
+			}
+			for i := range tt.want {
+				if objects[i].ID != tt.want[i].ID || !bytes.Equal(objects[i].Value, tt.want[i].Value) {
+					t.Errorf("object %d = %+v, want %+v", i, objects[i], tt.want[i])
+				}
+			}
+			if got := hex.EncodeToString(unknown); got != tt.unknown {
+				t.Errorf("unknown = %s, want %s", got, tt.unknown)
+			}
+		})
+	}
+
+	for _, b := range []string{"02ca", "53", "530c4865"} {
+		if _, _, err := ParseObjects(unhex(t, b)); err == nil {
+			t.Errorf("ParseObjects(%s) succeeded, want an error", b)
+		}
+	}
+}
+
+func TestDataApply(t *testing.T) {
+	objects, _, err := ParseObjects(unhex(t, "0161"+"02ca09"+"03bf13"+"04138a01"+"05138a14"+"0c020c"+"12e204"+"2101"+"2d00"+"3a01"))
+	if err != nil {
+		t.Fatalf("ParseObjects: %s", err)
+	}
+
+	var d Data
+	for _, obj := range objects {
+		d.apply(obj)
+	}
+
+	floats := []struct {
+		name string
+		got  *float32
+		want float32
+	}{
+		{"temperature", d.Temperature, 25.06},
+		{"humidity", d.Humidity, 50.55},
+		{"pressure", d.Pressure, 1008.83},
+		{"illuminance", d.Illuminance, 13460.67},
+		{"voltage", d.Voltage, 3.074},
+	}
+	for _, f := range floats {
+		if f.got == nil || *f.got-f.want > 0.001 || f.want-*f.got > 0.001 {
+			t.Errorf("%s = %v, want %v", f.name, f.got, f.want)
+		}
+	}
+	if d.Battery == nil || *d.Battery != 97 {
+		t.Errorf("battery = %v, want 97", d.Battery)
+	}
+	if d.CO2 == nil || *d.CO2 != 1250 {
+		t.Errorf("CO2 = %v, want 1250", d.CO2)
+	}
+	if d.Motion == nil || !*d.Motion {
+		t.Errorf("motion = %v, want true", d.Motion)
+	}
+	if d.Window == nil || *d.Window {
+		t.Errorf("window = %v, want false", d.Window)
+	}
+	if d.Button == nil || *d.Button != 1 {
+		t.Errorf("button = %v, want 1", d.Button)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	// the encryption example of https://bthome.io/encryption/
+	key := unhex(t, "231d39c1d7cc1ab1aee224cd096db932")
+	mac := unhex(t, "5448e68f80a5")
+	frame := unhex(t, "d2fc41a47266c95f730011223378237214")
+
+	payload, err := Decrypt(frame, mac, key)
+	if err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if got := hex.EncodeToString(payload); got != "02ca0903bf13" {
+		t.Errorf("Decrypt = %s, want 02ca0903bf13", got)
+	}
+
+	wrongMAC := unhex(t, "5448e68f80a6")
+	if _, err := Decrypt(frame, wrongMAC, key); !errors.Is(err, ccm.ErrAuth) {
+		t.Errorf("Decrypt with the wrong MAC: got error %v, want ErrAuth", err)
+	}
+	tampered := append([]byte(nil), frame...)
+	tampered[4] ^= 0x01
+	if _, err := Decrypt(tampered, mac, key); !errors.Is(err, ccm.ErrAuth) {
+		t.Errorf("Decrypt of a modified frame: got error %v, want ErrAuth", err)
+	}
+	if _, err := Decrypt(frame[:11], mac, key); err == nil {
+		t.Error("Decrypt of a truncated frame succeeded, want an error")
+	}
+}
+
+func TestHandleBroadcastUnknownObject(t *testing.T) {
+	bs, err := NewBTHomeSensor(&config.SensorConfig{Name: "test", MAC: "54:48:e6:8f:80:a5", Firmware: Firmware}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &hci.AdStructure{Typ: hci.AdServiceData, Data: unhex(t, "d2fc40"+"0001"+"02ca09"+"fe0102")}
+	if err := bs.handleBroadcast(&host.ScanReport{}, msg); err != nil {
+		t.Fatalf("handleBroadcast: %s", err)
+	}
+	if !bs.unknown[0xfe] {
+		t.Error("the unknown object ID was not recorded")
+	}
+
+	r := bs.GetLastReading()
+	if r == nil {
+		t.Fatal("no reading recorded")
+	}
+	if m, ok := r.Get(sensors.Temperature); !ok || m.Value < 25.05 || m.Value > 25.07 {
+		t.Errorf("temperature = %+v, want 25.06", m)
+	}
+}
+
+func TestHandleBroadcastStats(t *testing.T) {
+	bs, err := NewBTHomeSensor(&config.SensorConfig{Name: "test", MAC: "54:48:e6:8f:80:a5", Firmware: Firmware}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{
+		"0001" + "02ca09", // temperature 25.06
+		"0002" + "03bf13", // humidity 50.55
+		"0002" + "03bf13", // repeated
+		"0003" + "02d209", // temperature 25.14
+	} {
+		msg := &hci.AdStructure{Typ: hci.AdServiceData, Data: unhex(t, "d2fc40"+payload)}
+		if err := bs.handleBroadcast(&host.ScanReport{}, msg); err != nil {
+			t.Fatalf("handleBroadcast: %s", err)
+		}
+	}
+
+	// the last reading merges the objects of all the frames, while the statistics only count
+	// each object once.
+	r := bs.GetLastReading()
+	if m, ok := r.Get(sensors.Humidity); !ok || m.Value < 50.54 || m.Value > 50.56 {
+		t.Errorf("humidity = %+v, want 50.55", m)
+	}
+
+	stats := bs.Stats.Take()
+	if len(stats) != 2 {
+		t.Fatalf("got stats %+v, want temperature and humidity", stats)
+	}
+	if st := stats[0]; st.Quantity != sensors.Temperature || st.Count != 2 || st.Min > 25.07 || st.Max < 25.13 {
+		t.Errorf("temperature stats = %+v, want 2 samples from 25.06 to 25.14", st)
+	}
+	if st := stats[1]; st.Quantity != sensors.Humidity || st.Count != 1 {
+		t.Errorf("humidity stats = %+v, want 1 sample", st)
+	}
+}
+
+func TestHandleBroadcastButton(t *testing.T) {
+	bs, err := NewBTHomeSensor(&config.SensorConfig{Name: "test", MAC: "54:48:e6:8f:80:a5", Firmware: Firmware}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tt := range []struct {
+		payload string
+		button  bool
+	}{
+		{"0001" + "3a01" + "02ca09", true}, // press, temperature 25.06
+		{"0002" + "02d209", false},         // temperature 25.14
+	} {
+		msg := &hci.AdStructure{Typ: hci.AdServiceData, Data: unhex(t, "d2fc40"+tt.payload)}
+		if err := bs.handleBroadcast(&host.ScanReport{}, msg); err != nil {
+			t.Fatalf("handleBroadcast: %s", err)
+		}
+
+		r := bs.GetLastReading()
+		if _, ok := r.Get(sensors.Temperature); !ok {
+			t.Errorf("frame %d: no temperature in %+v", i, r.Measurements)
+		}
+		if m, ok := r.Get(sensors.Button); ok != tt.button || (ok && m.Value != 1) {
+			t.Errorf("frame %d: button = %+v (%t), want %t", i, m, ok, tt.button)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package sensors
+
+import (
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+)
+
+// Filters for the sensors that can't be recognised by the start of their advertising data,
+// because they don't use a stable manufacturer ID or service UUID; they complement the filters
+// provided by bluewalker.
+
+type localNameFilter struct {
+	names map[string]bool
+}
+
+func (f *localNameFilter) Filter(report *hci.AdvertisingReport) bool {
+	for _, data := range report.Data {
+		if data.Typ == hci.AdCompleteLocalName || data.Typ == hci.AdShortenedLocalName {
+			if f.names[string(data.Data)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ByLocalName returns a filter matching the reports advertising one of the given local names,
+// either complete or shortened.
+func ByLocalName(names ...string) filter.AdFilter {
+	f := localNameFilter{names: make(map[string]bool)}
+	for _, name := range names {
+		f.names[name] = true
+	}
+	return &f
+}
+
+type adDataLengthFilter struct {
+	typ     hci.AdType
+	lengths map[int]bool
+}
+
+func (f *adDataLengthFilter) Filter(report *hci.AdvertisingReport) bool {
+	for _, data := range report.Data {
+		if data.Typ == f.typ && f.lengths[len(data.Data)] {
+			return true
+		}
+	}
+	return false
+}
+
+// ByAdDataLength returns a filter matching the reports carrying advertising data of the given
+// type having one of the given lengths.
+func ByAdDataLength(typ hci.AdType, lengths ...int) filter.AdFilter {
+	f := adDataLengthFilter{typ: typ, lengths: make(map[int]bool)}
+	for _, l := range lengths {
+		f.lengths[l] = true
+	}
+	return &f
+}
+
+// LocalName returns the local name advertised in a report, if any.
+func LocalName(data []*hci.AdStructure) (string, bool) {
+	for _, ads := range data {
+		if ads.Typ == hci.AdCompleteLocalName || ads.Typ == hci.AdShortenedLocalName {
+			return string(ads.Data), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,260 @@
+// Sensors whose advertisements are described in the configuration file, for the devices sending
+// their measurements as fixed offset integers.
+
+package generic
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Firmware is the name of the generic driver in the configuration file.
+const Firmware = "generic"
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:     Firmware,
+		SensorFilter: sensorFilter,
+		Validate:     validateConfig,
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewGenericSensor(config, id)
+		},
+	})
+}
+
+type field struct {
+	name      string
+	offset    int
+	width     int
+	bigEndian bool
+	signed    bool
+	scale     float64
+	unit      string
+}
+
+// Decoder finds and decodes the measurements described by a config.Decoder.
+type Decoder struct {
+	adType      hci.AdType
+	prefix      []byte // the manufacturer ID or the service UUID, little endian
+	length      int
+	addressType hci.BtAddressType
+	fields      []field
+}
+
+// NewDecoder returns the decoder for the advertisements described in a sensor configuration.
+func NewDecoder(c *config.Decoder) (*Decoder, error) {
+	if c == nil {
+		return nil, errors.New("the generic firmware needs a decoder section")
+	}
+
+	d := Decoder{
+		adType:      hci.AdManufacturerSpecific,
+		length:      c.Length,
+		addressType: hci.LePublicAddress,
+	}
+	if c.AdType == "service_data" {
+		d.adType = hci.AdServiceData
+	}
+	if c.AddressType == "random" {
+		d.addressType = hci.LeRandomAddress
+	}
+	if c.ID != nil {
+		d.prefix = make([]byte, 2)
+		binary.LittleEndian.PutUint16(d.prefix, *c.ID)
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range c.Fields {
+		if f.Name == "time" || f.Name == "room" || seen[f.Name] {
+			return nil, fmt.Errorf("invalid field name %q", f.Name)
+		}
+		seen[f.Name] = true
+
+		if f.Width < 1 || f.Width > 4 {
+			return nil, fmt.Errorf("field %q: invalid width %d", f.Name, f.Width)
+		}
+		if f.Offset < len(d.prefix) {
+			return nil, fmt.Errorf("field %q overlaps the ID", f.Name)
+		}
+		if d.length > 0 && f.Offset+f.Width > d.length {
+			return nil, fmt.Errorf("field %q exceeds the advertising data length", f.Name)
+		}
+
+		scale := f.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		d.fields = append(d.fields, field{
+			name:      f.Name,
+			offset:    f.Offset,
+			width:     f.Width,
+			bigEndian: f.Endian == "big",
+			signed:    f.Signed,
+			scale:     scale,
+			unit:      f.Unit,
+		})
+	}
+
+	return &d, nil
+}
+
+// Filter returns the filter matching the advertisements described by the decoder.
+func (d *Decoder) Filter() filter.AdFilter {
+	switch {
+	case d.prefix != nil && d.length > 0:
+		return filter.All([]filter.AdFilter{
+			filter.ByAdData(d.adType, d.prefix),
+			sensors.ByAdDataLength(d.adType, d.length),
+		})
+	case d.prefix != nil:
+		return filter.ByAdData(d.adType, d.prefix)
+	default:
+		return sensors.ByAdDataLength(d.adType, d.length)
+	}
+}
+
+func (d *Decoder) checkReport(r *hci.AdStructure) bool {
+	if r.Typ != d.adType || len(r.Data) < len(d.prefix) {
+		return false
+	}
+	if d.length > 0 && len(r.Data) != d.length {
+		return false
+	}
+	for i, b := range d.prefix {
+		if r.Data[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode returns the values of all the fields, in the order they were configured; the field names
+// are used as quantities.
+func (d *Decoder) Decode(b []byte) ([]sensors.Measurement, error) {
+	values := make([]sensors.Measurement, len(d.fields))
+	for i, f := range d.fields {
+		if f.offset+f.width > len(b) {
+			return nil, fmt.Errorf("message too short for field %q: %d bytes", f.name, len(b))
+		}
+
+		var v uint32
+		for j := 0; j < f.width; j++ {
+			var c byte
+			if f.bigEndian {
+				c = b[f.offset+j]
+			} else {
+				c = b[f.offset+f.width-1-j]
+			}
+			v = v<<8 | uint32(c)
+		}
+
+		var n float64
+		if f.signed {
+			// sign extend the value to 32 bits.
+			shift := 32 - 8*f.width
+			n = float64(int32(v<<shift) >> shift)
+		} else {
+			n = float64(v)
+		}
+
+		values[i] = sensors.Measurement{
+			Quantity: sensors.Quantity(f.name),
+			Unit:     sensors.Unit(f.unit),
+			Value:    n * f.scale,
+		}
+	}
+	return values, nil
+}
+
+func sensorFilter(config *config.SensorConfig) (hci.BtAddressType, filter.AdFilter, error) {
+	d, err := NewDecoder(config.Decoder)
+	if err != nil {
+		return 0, nil, err
+	}
+	return d.addressType, d.Filter(), nil
+}
+
+// validateConfig checks the decoder, and that every field has a column in the table of the driver,
+// since the field names are used as column names.
+func validateConfig(config *config.SensorConfig) error {
+	if _, err := NewDecoder(config.Decoder); err != nil {
+		return err
+	}
+
+	driver, err := sensors.Lookup(Firmware)
+	if err != nil {
+		return err
+	}
+	for _, f := range config.Decoder.Fields {
+		if !driver.HasColumn(f.Name) {
+			return fmt.Errorf("field %q: the %s table of doc/schema.sql has no such column", f.Name, driver.SchemaTable())
+		}
+	}
+	return nil
+}
+
+type GenericSensor struct {
+	*sensors.Sensor
+
+	decoder *Decoder
+}
+
+func NewGenericSensor(config *config.SensorConfig, id uint64) (*GenericSensor, error) {
+	decoder, err := NewDecoder(config.Decoder)
+	if err != nil {
+		return nil, err
+	}
+
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Generic",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Unknown",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	gs := GenericSensor{
+		Sensor:  s,
+		decoder: decoder,
+	}
+	return &gs, nil
+}
+
+func (g *GenericSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if g.decoder.checkReport(ads) {
+			if err := g.handleBroadcast(report, ads); err != nil {
+				log.Printf("%s: %s", g.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleBroadcast records the decoded fields; the "temperature" and "humidity" fields are sent to
+// HomeKit.
+func (g *GenericSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	values, err := g.decoder.Decode(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	r := g.NewReading(report)
+	r.Measurements = values
+	g.Record(r)
+
+	return nil
+}
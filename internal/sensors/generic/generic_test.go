@@ -0,0 +1,183 @@
+package generic
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+)
+
+func TestDecode(t *testing.T) {
+	// the same bytes are read by every field, at offset 1.
+	data := []byte{0x00, 0xfe, 0xdc, 0xba, 0x98}
+
+	tests := []struct {
+		width  int
+		endian string
+		signed bool
+		scale  float64
+		want   float64
+	}{
+		{width: 1, want: 0xfe},
+		{width: 1, signed: true, want: -2},
+		{width: 1, endian: "big", signed: true, scale: 0.5, want: -1},
+		{width: 2, want: 0xdcfe},
+		{width: 2, endian: "big", want: 0xfedc},
+		{width: 2, signed: true, want: -0x2302},
+		{width: 2, endian: "big", signed: true, want: -0x0124},
+		{width: 2, signed: true, scale: 0.01, want: -89.62},
+		{width: 3, want: 0xbadcfe},
+		{width: 3, endian: "big", want: 0xfedcba},
+		{width: 3, signed: true, want: -0x452302},
+		{width: 3, endian: "big", signed: true, want: -0x012346},
+		{width: 4, want: 0x98badcfe},
+		{width: 4, endian: "big", want: 0xfedcba98},
+		{width: 4, signed: true, want: -0x67452302},
+		{width: 4, endian: "big", signed: true, want: -0x01234568},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(&config.Decoder{
+			AdType: "manufacturer",
+			Length: len(data),
+			Fields: []config.Field{{
+				Name: "value", Offset: 1, Width: tt.width, Endian: tt.endian, Signed: tt.signed, Scale: tt.scale, Unit: "°C",
+			}},
+		})
+		if err != nil {
+			t.Fatalf("NewDecoder: %s", err)
+		}
+
+		values, err := d.Decode(data)
+		if err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		want := sensors.Measurement{Quantity: "value", Unit: sensors.UnitCelsius, Value: tt.want}
+		if len(values) != 1 || values[0].Quantity != want.Quantity || values[0].Unit != want.Unit ||
+			math.Abs(values[0].Value-want.Value) > 1e-9 {
+			t.Errorf("width %d, endian %q, signed %v, scale %v: got %+v, want %+v",
+				tt.width, tt.endian, tt.signed, tt.scale, values, want)
+		}
+	}
+}
+
+func TestDecodeShortMessage(t *testing.T) {
+	d, err := NewDecoder(&config.Decoder{
+		AdType: "service_data",
+		ID:     ptr(uint16(0x181a)),
+		Fields: []config.Field{{Name: "temperature", Offset: 8, Width: 2}},
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder: %s", err)
+	}
+	if _, err := d.Decode(make([]byte, 9)); err == nil {
+		t.Error("Decode of a short message succeeded, want an error")
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestNewDecoderInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		decoder *config.Decoder
+	}{
+		{name: "no decoder"},
+		{
+			name:    "reserved name",
+			decoder: &config.Decoder{AdType: "manufacturer", Length: 8, Fields: []config.Field{{Name: "time", Width: 1}}},
+		},
+		{
+			name: "duplicate name",
+			decoder: &config.Decoder{AdType: "manufacturer", Length: 8, Fields: []config.Field{
+				{Name: "temperature", Offset: 2, Width: 2},
+				{Name: "temperature", Offset: 4, Width: 2},
+			}},
+		},
+		{
+			name: "overlapping the ID",
+			decoder: &config.Decoder{AdType: "manufacturer", ID: ptr(uint16(0x0499)), Fields: []config.Field{
+				{Name: "temperature", Offset: 1, Width: 2},
+			}},
+		},
+		{
+			name:    "beyond the length",
+			decoder: &config.Decoder{AdType: "manufacturer", Length: 8, Fields: []config.Field{{Name: "temperature", Offset: 7, Width: 2}}},
+		},
+		{
+			name:    "zero width",
+			decoder: &config.Decoder{AdType: "manufacturer", Length: 8, Fields: []config.Field{{Name: "temperature", Offset: 2}}},
+		},
+		{
+			name:    "too wide",
+			decoder: &config.Decoder{AdType: "manufacturer", Length: 8, Fields: []config.Field{{Name: "temperature", Offset: 2, Width: 5}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoder(tt.decoder); err == nil {
+				t.Error("NewDecoder succeeded, want an error")
+			}
+			if err := validateConfig(&config.SensorConfig{Decoder: tt.decoder}); err == nil {
+				t.Error("validateConfig succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDecoderValidate(t *testing.T) {
+	valid := config.Decoder{
+		AdType: "service_data",
+		ID:     ptr(uint16(0x181a)),
+		Fields: []config.Field{{Name: "temperature", Offset: 8, Width: 2, Endian: "big", Signed: true, Scale: 0.1}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(d *config.Decoder)
+	}{
+		{"unknown ad type", func(d *config.Decoder) { d.AdType = "name" }},
+		{"no id nor length", func(d *config.Decoder) { d.ID = nil }},
+		{"unknown address type", func(d *config.Decoder) { d.AddressType = "static" }},
+		{"no fields", func(d *config.Decoder) { d.Fields = nil }},
+		{"invalid field name", func(d *config.Decoder) { d.Fields[0].Name = "Temperature;" }},
+		{"negative offset", func(d *config.Decoder) { d.Fields[0].Offset = -1 }},
+		{"width too large", func(d *config.Decoder) { d.Fields[0].Width = 8 }},
+		{"unknown endianness", func(d *config.Decoder) { d.Fields[0].Endian = "middle" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := valid
+			d.Fields = append([]config.Field(nil), valid.Fields...)
+			tt.modify(&d)
+			if err := d.Validate(); err == nil {
+				t.Error("Validate succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestValidateConfigColumns(t *testing.T) {
+	decoder := func(names ...string) *config.Decoder {
+		d := config.Decoder{AdType: "manufacturer", Length: 8}
+		for i, name := range names {
+			d.Fields = append(d.Fields, config.Field{Name: name, Offset: 2 + i, Width: 1})
+		}
+		return &d
+	}
+
+	if err := validateConfig(&config.SensorConfig{Decoder: decoder("temperature", "humidity", "co2")}); err != nil {
+		t.Errorf("validateConfig: %s", err)
+	}
+
+	err := validateConfig(&config.SensorConfig{Decoder: decoder("temperature", "soil_ph")})
+	if err == nil || !strings.Contains(err.Error(), `"soil_ph"`) {
+		t.Errorf("validateConfig = %v, want an error about soil_ph", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Govee thermo-hygrometers H5072, H5075, H5101, H5102 (packed format), H5074 and H5179
+// https://github.com/Bluetooth-Devices/govee-ble
+
+package govee
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Manufacturer IDs used by the Govee sensors: most models use 0xEC88, while the H5179 uses
+// 0x0001.
+const (
+	UUID      = 0xec88
+	UUIDH5179 = 0x0001
+)
+
+// Firmware is the name of the Govee driver in the configuration file.
+const Firmware = "govee"
+
+// Sizes of the manufacturer data, including the manufacturer ID, of the supported formats.
+const (
+	packedPayloadSize = 8
+	h5074PayloadSize  = 9
+	h5179PayloadSize  = 11
+)
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter: filter.Any([]filter.AdFilter{
+			filter.ByVendor([]byte{0x88, 0xec}),
+			filter.ByVendor([]byte{0x01, 0x00}),
+		}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewGoveeSensor(config, id), nil
+		},
+	})
+}
+
+type Data struct {
+	Temperature float32
+	Humidity    float32
+	Battery     uint16
+}
+
+// decodePacked decodes the 3 bytes big endian value used by the H5075 and similar models to
+// store both the temperature and the humidity: the most significant bit is the sign of the
+// temperature, and the rest of the value is temperature * 10000 + humidity * 10.
+func decodePacked(b []byte) (float32, float32) {
+	v := uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	negative := v&0x800000 != 0
+	v &= 0x7fffff
+
+	temperature := float32(v/1000) / 10
+	humidity := float32(v%1000) / 10
+	if negative {
+		temperature = -temperature
+	}
+
+	return temperature, humidity
+}
+
+// parseMessage decodes the manufacturer data b, including the manufacturer ID; the model is
+// recognised by the size of the data.
+func parseMessage(b []byte) (*Data, error) {
+	if len(b) < 2 {
+		return nil, errors.New("govee message too short")
+	}
+	mid := binary.LittleEndian.Uint16(b)
+
+	var data Data
+	switch {
+	case mid == UUID && len(b) == packedPayloadSize:
+		data.Temperature, data.Humidity = decodePacked(b[3:6])
+		// the most significant bit is an error flag.
+		data.Battery = uint16(b[6] & 0x7f)
+	case mid == UUID && len(b) == h5074PayloadSize:
+		data.Temperature = float32(int16(binary.LittleEndian.Uint16(b[3:5]))) / 100
+		data.Humidity = float32(binary.LittleEndian.Uint16(b[5:7])) / 100
+		data.Battery = uint16(b[7])
+	case mid == UUIDH5179 && len(b) == h5179PayloadSize:
+		data.Temperature = float32(int16(binary.LittleEndian.Uint16(b[6:8]))) / 100
+		data.Humidity = float32(binary.LittleEndian.Uint16(b[8:10])) / 100
+		data.Battery = uint16(b[10])
+	default:
+		return nil, fmt.Errorf("unknown govee message format (manufacturer ID 0x%04x, %d bytes)", mid, len(b))
+	}
+
+	return &data, nil
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	if r.Typ != hci.AdManufacturerSpecific || len(r.Data) < 2 {
+		return false
+	}
+	mid := binary.LittleEndian.Uint16(r.Data)
+	return mid == UUID || mid == UUIDH5179
+}
+
+type GoveeSensor struct {
+	*sensors.Sensor
+}
+
+func NewGoveeSensor(config *config.SensorConfig, id uint64) *GoveeSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Govee Thermo-Hygrometer",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Govee",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	gs := GoveeSensor{
+		Sensor: s,
+	}
+	return &gs
+}
+
+func (g *GoveeSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := g.handleBroadcast(report, ads); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (g *GoveeSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	data, err := parseMessage(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	r := g.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	g.Record(r)
+
+	return nil
+}
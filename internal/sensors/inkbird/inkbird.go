@@ -0,0 +1,143 @@
+// Inkbird IBS-TH1 and IBS-TH2 thermometers
+// https://github.com/Bluetooth-Devices/inkbird-ble
+
+package inkbird
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Firmware is the name of the Inkbird driver in the configuration file.
+const Firmware = "inkbird"
+
+// Local names advertised by the sensors; the IBS-TH2 has no humidity sensor.
+const (
+	nameIBSTH1 = "sps"
+	nameIBSTH2 = "tps"
+)
+
+// payloadSize is the size of the manufacturer data; there's no manufacturer ID, since its place
+// is taken by the temperature, so the messages are recognised by their size.
+const payloadSize = 9
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter: filter.Any([]filter.AdFilter{
+			sensors.ByLocalName(nameIBSTH1, nameIBSTH2),
+			sensors.ByAdDataLength(hci.AdManufacturerSpecific, payloadSize),
+		}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewInkbirdSensor(config, id), nil
+		},
+	})
+}
+
+// all the fields are little endian.
+type payload struct {
+	Temperature int16  // 0.01 °C
+	Humidity    uint16 // 0.01 %
+	ProbeType   uint8  // 1 when the external probe is connected
+	CRC         uint16
+	Battery     uint8
+	Unknown     uint8
+}
+
+type Data struct {
+	Temperature   float32
+	Humidity      *float32 // nil for the IBS-TH2, and until the model is known
+	Battery       uint16
+	ExternalProbe bool
+}
+
+func parseMessage(b []byte, localName string) (*Data, error) {
+	var p payload
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &p); err != nil {
+		return nil, err
+	}
+
+	data := Data{
+		Temperature:   float32(p.Temperature) / 100,
+		Battery:       uint16(p.Battery),
+		ExternalProbe: p.ProbeType == 1,
+	}
+	// the IBS-TH2 sends a meaningless humidity: it's only reported once the local name tells
+	// that the sensor is an IBS-TH1.
+	if localName == nameIBSTH1 {
+		humidity := float32(p.Humidity) / 100
+		data.Humidity = &humidity
+	}
+
+	return &data, nil
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdManufacturerSpecific && len(r.Data) == payloadSize
+}
+
+type InkbirdSensor struct {
+	*sensors.Sensor
+
+	// the local name is sent in the scan responses, which don't carry the measurements.
+	localName string
+}
+
+func NewInkbirdSensor(config *config.SensorConfig, id uint64) *InkbirdSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Inkbird IBS-TH",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Inkbird",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	is := InkbirdSensor{
+		Sensor: s,
+	}
+	return &is
+}
+
+func (ib *InkbirdSensor) Update(report *host.ScanReport) error {
+	if name, ok := sensors.LocalName(report.Data); ok {
+		ib.localName = name
+	}
+
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := ib.handleBroadcast(report, ads); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ib *InkbirdSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	data, err := parseMessage(msg.Data, ib.localName)
+	if err != nil {
+		return err
+	}
+
+	r := ib.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	sensors.AddOptional(r, sensors.Humidity, sensors.UnitPercent, data.Humidity)
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	ib.Record(r)
+
+	return nil
+}
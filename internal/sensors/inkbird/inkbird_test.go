@@ -0,0 +1,38 @@
+package inkbird
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	// 24.58 °C, 51.75%, no external probe, battery 87%.
+	b, err := hex.DecodeString("9a0937140013a15700")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		localName string
+		humidity  bool
+	}{
+		{localName: nameIBSTH1, humidity: true},
+		{localName: nameIBSTH2},
+		{localName: ""}, // the scan response wasn't received yet
+	}
+	for _, tt := range tests {
+		data, err := parseMessage(b, tt.localName)
+		if err != nil {
+			t.Fatalf("parseMessage: %s", err)
+		}
+		if data.Temperature != 24.58 || data.Battery != 87 || data.ExternalProbe {
+			t.Errorf("%q: got %+v", tt.localName, data)
+		}
+		switch {
+		case tt.humidity && (data.Humidity == nil || *data.Humidity != 51.75):
+			t.Errorf("%q: humidity = %v, want 51.75", tt.localName, data.Humidity)
+		case !tt.humidity && data.Humidity != nil:
+			t.Errorf("%q: humidity = %v, want nil", tt.localName, *data.Humidity)
+		}
+	}
+}
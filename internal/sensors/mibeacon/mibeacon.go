@@ -0,0 +1,449 @@
+// Xiaomi MiBeacon advertisements, sent by the sensors running the stock Xiaomi firmware
+// (LYWSDCGQ, LYWSD03MMC, MHO-C401, ...), optionally encrypted with a per-device "bind key".
+// https://iot.mi.com/new/doc/accesses/direct-access/embedded-development/ble/object-definition
+// https://custom-components.github.io/ble_monitor/MiBeacon_protocol
+
+package mibeacon
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/ccm"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Service UUID: Xiaomi Inc.
+const UUID = 0xfe95
+
+// Firmware is the name of the MiBeacon driver in the configuration file.
+const Firmware = "mibeacon"
+
+// Frame control bits.
+const (
+	ctrlEncrypted         = 1 << 3
+	ctrlMACInclude        = 1 << 4
+	ctrlCapabilityInclude = 1 << 5
+	ctrlObjectInclude     = 1 << 6
+)
+
+// capabilityIO is set in the capability byte when it's followed by 2 bytes of I/O capability.
+const capabilityIO = 1 << 5
+
+// Object IDs.
+const (
+	objTemperature         = 0x1004
+	objHumidity            = 0x1006
+	objBattery             = 0x100a
+	objTemperatureHumidity = 0x100d
+	objTemperatureFloat    = 0x4c01
+	objHumidityByte        = 0x4c02
+	objHumidityFloat       = 0x4c08
+	objBatteryByte         = 0x4803
+	objIlluminance         = 0x1007
+	objMoisture            = 0x1008
+	objConductivity        = 0x1009
+)
+
+// Sizes of the bind keys: MiBeacon v4 and v5 use a 16 bytes key, while the legacy encryption
+// of the v2 and v3 frames uses a 12 bytes key.
+const (
+	keySize       = 16
+	legacyKeySize = 12
+)
+
+// ErrNoBindKey is returned when an encrypted frame is received from a sensor without a bind key.
+var ErrNoBindKey = errors.New("encrypted MiBeacon frame but no bindkey configured")
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter:      filter.ByAdData(hci.AdServiceData, []byte{0x95, 0xfe}),
+		Validate:    validateConfig,
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewMiBeaconSensor(config, id)
+		},
+	})
+}
+
+func validateConfig(sc *config.SensorConfig) error {
+	_, err := decodeBindKey(sc.BindKey)
+	return err
+}
+
+func decodeBindKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bindkey: %w", err)
+	}
+	if len(key) != keySize && len(key) != legacyKeySize {
+		return nil, fmt.Errorf("invalid bindkey: must be %d or %d bytes long, not %d", keySize, legacyKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// Frame is a decoded MiBeacon frame.
+type Frame struct {
+	Control   uint16
+	ProductID uint16
+	Counter   uint8
+	Objects   []byte // the plain text objects payload; empty if the frame doesn't carry any object
+}
+
+// Version returns the MiBeacon version of the frame.
+func (f *Frame) Version() int {
+	return int(f.Control >> 12)
+}
+
+// ParseFrame decodes the MiBeacon service data b, decrypting its payload when needed; mac is
+// the sensor MAC address in little endian order, used when the frame doesn't include it.
+func ParseFrame(b []byte, mac []byte, key []byte) (*Frame, error) {
+	if len(b) < 7 {
+		return nil, fmt.Errorf("MiBeacon frame too short: %d bytes", len(b))
+	}
+
+	// skip the UUID
+	b = b[2:]
+	f := Frame{
+		Control:   binary.LittleEndian.Uint16(b[0:2]),
+		ProductID: binary.LittleEndian.Uint16(b[2:4]),
+		Counter:   b[4],
+	}
+	i := 5
+
+	if f.Control&ctrlMACInclude != 0 {
+		if len(b) < i+6 {
+			return nil, errors.New("MiBeacon frame too short for the MAC address")
+		}
+		mac = b[i : i+6]
+		i += 6
+	}
+
+	if f.Control&ctrlCapabilityInclude != 0 {
+		if len(b) < i+1 {
+			return nil, errors.New("MiBeacon frame too short for the capability")
+		}
+		if b[i]&capabilityIO != 0 {
+			i += 2
+		}
+		i++
+	}
+
+	if f.Control&ctrlObjectInclude == 0 || len(b) <= i {
+		return &f, nil
+	}
+	payload := b[i:]
+
+	if f.Control&ctrlEncrypted == 0 {
+		f.Objects = payload
+		return &f, nil
+	}
+
+	if key == nil {
+		return nil, ErrNoBindKey
+	}
+	if len(mac) != 6 {
+		return nil, errors.New("the MAC address is required to decrypt MiBeacon frames")
+	}
+
+	var err error
+	if f.Version() >= 4 {
+		f.Objects, err = decrypt(b, payload, mac, key)
+	} else {
+		f.Objects, err = decryptLegacy(b, payload, mac, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// decrypt decrypts the payload of a MiBeacon v4 or v5 frame, which is followed by 3 bytes of
+// extended counter and 4 bytes of authentication tag.
+func decrypt(frame, payload, mac, key []byte) ([]byte, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("MiBeacon v4/v5 frames need a %d bytes bindkey", keySize)
+	}
+	if len(payload) < 3+4+1 {
+		return nil, errors.New("encrypted MiBeacon payload too short")
+	}
+
+	n := len(payload)
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, mac...)
+	nonce = append(nonce, frame[2:5]...) // product ID and frame counter
+	nonce = append(nonce, payload[n-7:n-4]...)
+
+	ciphertext := make([]byte, 0, n-3)
+	ciphertext = append(ciphertext, payload[:n-7]...)
+	ciphertext = append(ciphertext, payload[n-4:]...)
+
+	return ccm.Open(key, nonce, ciphertext, []byte{0x11}, 4)
+}
+
+// decryptLegacy decrypts the payload of a MiBeacon v2 or v3 frame; those frames don't carry
+// a complete authentication tag, so the payload can't be authenticated.
+func decryptLegacy(frame, payload, mac, key []byte) ([]byte, error) {
+	if len(key) != legacyKeySize {
+		return nil, fmt.Errorf("MiBeacon v2/v3 frames need a %d bytes bindkey", legacyKeySize)
+	}
+	if len(payload) < 4+1 {
+		return nil, errors.New("encrypted MiBeacon payload too short")
+	}
+
+	fullKey := make([]byte, 0, keySize)
+	fullKey = append(fullKey, key[:6]...)
+	fullKey = append(fullKey, 0x8d, 0x3d, 0x3c, 0x97)
+	fullKey = append(fullKey, key[6:]...)
+
+	n := len(payload)
+	nonce := make([]byte, 0, 13)
+	nonce = append(nonce, frame[0:5]...) // frame control, product ID and frame counter
+	nonce = append(nonce, payload[n-4:n-1]...)
+	nonce = append(nonce, mac[:5]...)
+
+	return ccm.Decrypt(fullKey, nonce, payload[:n-4])
+}
+
+// Object is a single MiBeacon object: a measurement identified by its ID.
+type Object struct {
+	ID    uint16
+	Value []byte
+}
+
+// ParseObjects splits a MiBeacon objects payload into its objects.
+func ParseObjects(b []byte) ([]Object, error) {
+	var objects []Object
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return objects, errors.New("truncated MiBeacon object header")
+		}
+		id := binary.LittleEndian.Uint16(b[0:2])
+		size := int(b[2])
+		if len(b) < 3+size {
+			return objects, fmt.Errorf("truncated MiBeacon object 0x%04x", id)
+		}
+		objects = append(objects, Object{ID: id, Value: b[3 : 3+size]})
+		b = b[3+size:]
+	}
+	return objects, nil
+}
+
+// Data holds the latest values received from a sensor; since each advertisement usually
+// carries a single object, the fields are nil until the first value is received.
+type Data struct {
+	Temperature  *float32
+	Humidity     *float32
+	Battery      *uint16
+	Illuminance  *uint32 // lux
+	Moisture     *uint16 // %
+	Conductivity *uint16 // µS/cm
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// apply stores the value of a known object into d; unknown objects are ignored.
+func (d *Data) apply(obj Object) error {
+	v := obj.Value
+	tooShort := func(size int) error {
+		if len(v) < size {
+			return fmt.Errorf("MiBeacon object 0x%04x too short: %d bytes", obj.ID, len(v))
+		}
+		return nil
+	}
+
+	switch obj.ID {
+	case objTemperature:
+		if err := tooShort(2); err != nil {
+			return err
+		}
+		d.Temperature = ptr(float32(int16(binary.LittleEndian.Uint16(v))) / 10)
+	case objHumidity:
+		if err := tooShort(2); err != nil {
+			return err
+		}
+		d.Humidity = ptr(float32(binary.LittleEndian.Uint16(v)) / 10)
+	case objBattery, objBatteryByte:
+		if err := tooShort(1); err != nil {
+			return err
+		}
+		d.Battery = ptr(uint16(v[0]))
+	case objTemperatureHumidity:
+		if err := tooShort(4); err != nil {
+			return err
+		}
+		d.Temperature = ptr(float32(int16(binary.LittleEndian.Uint16(v[0:2]))) / 10)
+		d.Humidity = ptr(float32(binary.LittleEndian.Uint16(v[2:4])) / 10)
+	case objTemperatureFloat:
+		if err := tooShort(4); err != nil {
+			return err
+		}
+		d.Temperature = ptr(math.Float32frombits(binary.LittleEndian.Uint32(v)))
+	case objHumidityByte:
+		if err := tooShort(1); err != nil {
+			return err
+		}
+		d.Humidity = ptr(float32(v[0]))
+	case objHumidityFloat:
+		if err := tooShort(4); err != nil {
+			return err
+		}
+		d.Humidity = ptr(math.Float32frombits(binary.LittleEndian.Uint32(v)))
+	case objIlluminance:
+		if err := tooShort(3); err != nil {
+			return err
+		}
+		d.Illuminance = ptr(uint32(v[0]) | uint32(v[1])<<8 | uint32(v[2])<<16)
+	case objMoisture:
+		if err := tooShort(1); err != nil {
+			return err
+		}
+		d.Moisture = ptr(uint16(v[0]))
+	case objConductivity:
+		if err := tooShort(2); err != nil {
+			return err
+		}
+		d.Conductivity = ptr(binary.LittleEndian.Uint16(v))
+	}
+
+	return nil
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdServiceData && len(r.Data) >= 2 && binary.LittleEndian.Uint16(r.Data) == UUID
+}
+
+type MiBeaconSensor struct {
+	*sensors.Sensor
+
+	// each advertisement carries a single object, so they are merged here.
+	data *Data
+
+	key         []byte
+	mac         []byte // little endian
+	lastCounter int
+}
+
+func NewMiBeaconSensor(config *config.SensorConfig, id uint64) (*MiBeaconSensor, error) {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Xiaomi Thermometer (stock firmware)",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Xiaomi",
+		ID:           id,
+	}
+
+	return newMiBeaconSensor(config, homekit.NewTemperatureHumiditySensor(info))
+}
+
+func newMiBeaconSensor(config *config.SensorConfig, acc *homekit.TemperatureHumiditySensor) (*MiBeaconSensor, error) {
+	key, err := decodeBindKey(config.BindKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hwAddr, err := net.ParseMAC(config.MAC)
+	if err != nil {
+		return nil, err
+	}
+	mac := make([]byte, len(hwAddr))
+	for i := range hwAddr {
+		mac[i] = hwAddr[len(hwAddr)-1-i]
+	}
+
+	s := sensors.NewSensor(config, acc)
+
+	ms := MiBeaconSensor{
+		Sensor:      s,
+		key:         key,
+		mac:         mac,
+		lastCounter: -1,
+	}
+	return &ms, nil
+}
+
+func (m *MiBeaconSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := m.handleBroadcast(report, ads); err != nil {
+				log.Printf("%s: %s", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decode decodes a MiBeacon frame and merges its objects into the data received so far; it
+// returns the data of the frame alone, or nil for a repeated frame or a frame without objects.
+func (m *MiBeaconSensor) decode(msg *hci.AdStructure) (*Data, error) {
+	frame, err := ParseFrame(msg.Data, m.mac, m.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sensors repeat each advertisement several times.
+	if len(frame.Objects) == 0 || int(frame.Counter) == m.lastCounter {
+		return nil, nil
+	}
+	m.lastCounter = int(frame.Counter)
+
+	objects, err := ParseObjects(frame.Objects)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.data == nil {
+		m.data = &Data{}
+	}
+	var fresh Data
+	for _, obj := range objects {
+		if err := m.data.apply(obj); err != nil {
+			return nil, err
+		}
+		fresh.apply(obj)
+	}
+
+	return &fresh, nil
+}
+
+// addClimate adds the measurements of a thermometer to a reading.
+func (d *Data) addClimate(r *sensors.Reading) {
+	sensors.AddOptional(r, sensors.Temperature, sensors.UnitCelsius, d.Temperature)
+	sensors.AddOptional(r, sensors.Humidity, sensors.UnitPercent, d.Humidity)
+	sensors.AddOptional(r, sensors.Battery, sensors.UnitPercent, d.Battery)
+}
+
+func (m *MiBeaconSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	fresh, err := m.decode(msg)
+	if err != nil || fresh == nil {
+		return err
+	}
+
+	r := m.NewReading(report)
+	m.data.addClimate(r)
+	sample := m.NewReading(report)
+	fresh.addClimate(sample)
+	m.RecordMerged(r, sample)
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package mibeacon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/ccm"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// serviceData prefixes a MiBeacon frame with the service UUID.
+func serviceData(frame string) []byte {
+	return append([]byte{0x95, 0xfe}, frame...)
+}
+
+// Advertisements captured from real sensors; the MAC addresses are in little endian order.
+var (
+	// LYWSD02MMC, MiBeacon v5 encrypted: humidity 58%.
+	lywsd02mmcFrame = "XX\xe4\x16,\x84SV8\xc1\xa4+n\xf2\xe9\x12\x00\x00l\x88M\x9e"
+	lywsd02mmcKey   = "a115210eed7a88e50ad52662e732a9fb"
+	lywsd02mmcMAC   = "\x84SV8\xc1\xa4"
+
+	// YLKG07YL dimmer, MiBeacon v3 with the legacy encryption: a rotation event (0x1001).
+	ylkg07ylFrame = "X0\xb6\x03\xd2\x8b\x98\xc5A$\xf8\xc3I\x14vu~\x00\x00\x00\x99"
+	ylkg07ylKey   = "b853075158487ca39a5b5ea9"
+)
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		mac     string
+		key     string
+		version int
+		product uint16
+		counter uint8
+		objects string
+	}{
+		{
+			name:    "LYWSDCGQ v2 plain text",
+			data:    "\x50\x20\xaa\x01\xda\x21\x76\x08\x54\xd5\xab\x0d\x10\x04\xfe\x00\x48\x02",
+			version: 2,
+			product: 0x01aa,
+			counter: 0xda,
+			objects: "0d1004fe004802",
+		},
+		{
+			name:    "LYWSD02MMC v5 encrypted",
+			data:    lywsd02mmcFrame,
+			key:     lywsd02mmcKey,
+			version: 5,
+			product: 0x16e4,
+			counter: 0x2c,
+			objects: "024c013a",
+		},
+		{
+			// the same frame without the MAC address, which is only used for the nonce.
+			name:    "LYWSD02MMC v5 encrypted without MAC",
+			data:    "\x48X\xe4\x16," + lywsd02mmcFrame[11:],
+			mac:     lywsd02mmcMAC,
+			key:     lywsd02mmcKey,
+			version: 5,
+			product: 0x16e4,
+			counter: 0x2c,
+			objects: "024c013a",
+		},
+		{
+			name:    "YLKG07YL v3 legacy encryption",
+			data:    ylkg07ylFrame,
+			key:     ylkg07ylKey,
+			version: 3,
+			product: 0x03b6,
+			counter: 0xd2,
+			objects: "011003000103",
+		},
+		{
+			name:    "capability and no objects",
+			data:    "\x30\x58\x5b\x05\x01\xf4\x83\x83\x38\xc1\xa4\x28\x01\x00",
+			version: 5,
+			product: 0x055b,
+			counter: 0x01,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key []byte
+			if tt.key != "" {
+				key = unhex(t, tt.key)
+			}
+
+			f, err := ParseFrame(serviceData(tt.data), []byte(tt.mac), key)
+			if err != nil {
+				t.Fatalf("ParseFrame: %s", err)
+			}
+			if f.Version() != tt.version || f.ProductID != tt.product || f.Counter != tt.counter {
+				t.Errorf("got version %d, product 0x%04x, counter %d; want %d, 0x%04x, %d",
+					f.Version(), f.ProductID, f.Counter, tt.version, tt.product, tt.counter)
+			}
+			if got := hex.EncodeToString(f.Objects); got != tt.objects {
+				t.Errorf("objects = %s, want %s", got, tt.objects)
+			}
+		})
+	}
+}
+
+func TestParseFrameErrors(t *testing.T) {
+	wrongKey := unhex(t, "00112233445566778899aabbccddeeff")
+
+	tests := []struct {
+		name string
+		data string
+		mac  string
+		key  []byte
+		err  error
+	}{
+		{name: "too short", data: "XX\xe4"},
+		{name: "truncated MAC", data: "XX\xe4\x16,\x84SV"},
+		{name: "no bindkey", data: lywsd02mmcFrame, err: ErrNoBindKey},
+		{name: "wrong bindkey", data: lywsd02mmcFrame, key: wrongKey, err: ccm.ErrAuth},
+		{name: "legacy bindkey for a v5 frame", data: lywsd02mmcFrame, key: unhex(t, ylkg07ylKey)},
+		{name: "v5 bindkey for a v3 frame", data: ylkg07ylFrame, key: unhex(t, lywsd02mmcKey)},
+		{name: "encrypted without MAC", data: "\x48X\xe4\x16," + lywsd02mmcFrame[11:], key: unhex(t, lywsd02mmcKey)},
+		{name: "payload too short", data: "XX\xe4\x16,\x84SV8\xc1\xa4+n\xf2", key: unhex(t, lywsd02mmcKey)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseFrame(serviceData(tt.data), []byte(tt.mac), tt.key)
+			if err == nil {
+				t.Fatal("ParseFrame succeeded, want an error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseObjects(t *testing.T) {
+	objects, err := ParseObjects(unhex(t, "0d1004fe004802"+"0a100164"))
+	if err != nil {
+		t.Fatalf("ParseObjects: %s", err)
+	}
+	want := []Object{
+		{ID: objTemperatureHumidity, Value: []byte{0xfe, 0x00, 0x48, 0x02}},
+		{ID: objBattery, Value: []byte{0x64}},
+	}
+	if len(objects) != len(want) {
+		t.Fatalf("got %d objects, want %d", len(objects), len(want))
+	}
+	for i := range want {
+		if objects[i].ID != want[i].ID || !bytes.Equal(objects[i].Value, want[i].Value) {
+			t.Errorf("object %d = %+v, want %+v", i, objects[i], want[i])
+		}
+	}
+
+	for _, b := range []string{"0d10", "0d1004fe00"} {
+		if _, err := ParseObjects(unhex(t, b)); err == nil {
+			t.Errorf("ParseObjects(%s) succeeded, want an error", b)
+		}
+	}
+}
+
+func TestDataApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects string
+		want    Data
+	}{
+		{
+			name:    "temperature and humidity",
+			objects: "0d1004fe004802",
+			want:    Data{Temperature: ptr(float32(25.4)), Humidity: ptr(float32(58.4))},
+		},
+		{
+			name:    "negative temperature",
+			objects: "041002a5ff",
+			want:    Data{Temperature: ptr(float32(-9.1))},
+		},
+		{
+			name:    "humidity byte and battery",
+			objects: "024c013a" + "03480155",
+			want:    Data{Humidity: ptr(float32(58)), Battery: ptr(uint16(85))},
+		},
+		{
+			name:    "float temperature",
+			objects: "014c040000b441",
+			want:    Data{Temperature: ptr(float32(22.5))},
+		},
+		{
+			name:    "plant sensor",
+			objects: "071003e80300" + "08100125" + "09100220d4",
+			want:    Data{Illuminance: ptr(uint32(1000)), Moisture: ptr(uint16(37)), Conductivity: ptr(uint16(54304))},
+		},
+		{
+			name:    "unknown object",
+			objects: "011003000103",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := ParseObjects(unhex(t, tt.objects))
+			if err != nil {
+				t.Fatalf("ParseObjects: %s", err)
+			}
+			var d Data
+			for _, obj := range objects {
+				if err := d.apply(obj); err != nil {
+					t.Fatalf("apply: %s", err)
+				}
+			}
+
+			checkValue(t, "temperature", d.Temperature, tt.want.Temperature)
+			checkValue(t, "humidity", d.Humidity, tt.want.Humidity)
+			checkValue(t, "battery", d.Battery, tt.want.Battery)
+			checkValue(t, "illuminance", d.Illuminance, tt.want.Illuminance)
+			checkValue(t, "moisture", d.Moisture, tt.want.Moisture)
+			checkValue(t, "conductivity", d.Conductivity, tt.want.Conductivity)
+		})
+	}
+
+	var d Data
+	if err := d.apply(Object{ID: objTemperatureHumidity, Value: []byte{0xfe, 0x00}}); err == nil {
+		t.Error("apply of a short object succeeded, want an error")
+	}
+}
+
+func checkValue[T comparable](t *testing.T, name string, got, want *T) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("%s = %v, want %v", name, got, want)
+	case *got != *want:
+		t.Errorf("%s = %v, want %v", name, *got, *want)
+	}
+}
+
+func TestHandleBroadcastStats(t *testing.T) {
+	ms, err := NewMiBeaconSensor(&config.SensorConfig{Name: "test", MAC: "ab:d5:54:08:76:21", Firmware: Firmware}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// v2 plain text frames, each with a single object.
+	frame := func(counter, objects string) *hci.AdStructure {
+		return &hci.AdStructure{
+			Typ:  hci.AdServiceData,
+			Data: serviceData("\x50\x20\xaa\x01" + counter + "\x21\x76\x08\x54\xd5\xab" + objects),
+		}
+	}
+	for _, msg := range []*hci.AdStructure{
+		frame("\x01", "\x04\x10\x02\xfe\x00"), // temperature 25.4
+		frame("\x01", "\x04\x10\x02\xfe\x00"), // repeated
+		frame("\x02", "\x06\x10\x02\x58\x02"), // humidity 60.0
+		frame("\x03", "\x04\x10\x02\x00\x01"), // temperature 25.6
+	} {
+		if err := ms.handleBroadcast(&host.ScanReport{}, msg); err != nil {
+			t.Fatalf("handleBroadcast: %s", err)
+		}
+	}
+
+	// the last reading merges the objects of all the frames...
+	r := ms.GetLastReading()
+	if r == nil {
+		t.Fatal("no reading recorded")
+	}
+	checkMeasurement(t, r, sensors.Temperature, 25.6)
+	checkMeasurement(t, r, sensors.Humidity, 60)
+
+	// ...while the statistics only count each object once.
+	stats := ms.Stats.Take()
+	if len(stats) != 2 {
+		t.Fatalf("got stats %+v, want temperature and humidity", stats)
+	}
+	if st := stats[0]; st.Quantity != sensors.Temperature || st.Count != 2 || !near(st.Min, 25.4) || !near(st.Max, 25.6) {
+		t.Errorf("temperature stats = %+v, want 2 samples from 25.4 to 25.6", st)
+	}
+	if st := stats[1]; st.Quantity != sensors.Humidity || st.Count != 1 || !near(st.Last, 60) {
+		t.Errorf("humidity stats = %+v, want 1 sample of 60", st)
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+func checkMeasurement(t *testing.T, r *sensors.Reading, q sensors.Quantity, want float64) {
+	t.Helper()
+	if m, ok := r.Get(q); !ok || !near(m.Value, want) {
+		t.Errorf("%s = %+v, want %v", q, m, want)
+	}
+}
@@ -0,0 +1,114 @@
+// Xiaomi Flower Care (MiFlora) plant sensor HHCCJCY01
+
+package mibeacon
+
+import (
+	"log"
+	"math"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// MiFloraFirmware is the name of the MiFlora driver in the configuration file.
+const MiFloraFirmware = "miflora"
+
+// minLightLevel is the minimum ambient light level accepted by HomeKit.
+const minLightLevel = 0.0001
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    MiFloraFirmware,
+		AddressType: hci.LePublicAddress,
+		Filter:      filter.ByAdData(hci.AdServiceData, []byte{0x95, 0xfe}),
+		Validate:    validateConfig,
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewMiFloraSensor(config, id)
+		},
+		Table: "home_plants",
+	})
+}
+
+// MiFloraSensor is a MiBeacon sensor sending the temperature, soil moisture, soil conductivity
+// and illuminance objects, each in a separate advertisement.
+type MiFloraSensor struct {
+	*MiBeaconSensor
+	Plant *homekit.PlantSensor
+}
+
+func NewMiFloraSensor(config *config.SensorConfig, id uint64) (*MiFloraSensor, error) {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Xiaomi Flower Care HHCCJCY01",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Xiaomi",
+		ID:           id,
+	}
+
+	acc := homekit.NewPlantSensor(info)
+	ms, err := newMiBeaconSensor(config, acc.TemperatureHumiditySensor)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := MiFloraSensor{
+		MiBeaconSensor: ms,
+		Plant:          acc,
+	}
+	mf.Columns = map[sensors.Quantity]string{sensors.Illuminance: "lux"}
+	mf.UpdateAccessory = mf.updateAccessory
+	return &mf, nil
+}
+
+func (m *MiFloraSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := m.handleBroadcast(report, ads); err != nil {
+				log.Printf("%s: %s", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MiFloraSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	fresh, err := m.decode(msg)
+	if err != nil || fresh == nil {
+		return err
+	}
+
+	r := m.NewReading(report)
+	m.data.addPlant(r)
+	sample := m.NewReading(report)
+	fresh.addPlant(sample)
+	m.RecordMerged(r, sample)
+
+	return nil
+}
+
+// addPlant adds the measurements of a plant sensor to a reading.
+func (d *Data) addPlant(r *sensors.Reading) {
+	sensors.AddOptional(r, sensors.Temperature, sensors.UnitCelsius, d.Temperature)
+	sensors.AddOptional(r, sensors.Moisture, sensors.UnitPercent, d.Moisture)
+	sensors.AddOptional(r, sensors.Conductivity, sensors.UnitMicroSiemensPerCm, d.Conductivity)
+	sensors.AddOptional(r, sensors.Illuminance, sensors.UnitLux, d.Illuminance)
+	sensors.AddOptional(r, sensors.Battery, sensors.UnitPercent, d.Battery)
+}
+
+// updateAccessory sends the soil moisture to HomeKit as the humidity.
+func (m *MiFloraSensor) updateAccessory(r *sensors.Reading) {
+	if v, ok := r.Get(sensors.Temperature); ok {
+		m.SetTemperature(v.Value)
+	}
+	if v, ok := r.Get(sensors.Moisture); ok {
+		m.SetHumidity(v.Value)
+	}
+	if v, ok := r.Get(sensors.Illuminance); ok {
+		m.Plant.LightSensor.CurrentAmbientLightLevel.SetValue(math.Max(v.Value, minLightLevel))
+	}
+}
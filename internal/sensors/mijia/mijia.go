@@ -5,19 +5,14 @@ package mijia
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
-	"errors"
-	"fmt"
 	"log"
-	"time"
 
 	"github.com/brutella/hc/accessory"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/piger/sensor-probe/internal/config"
-	"github.com/piger/sensor-probe/internal/db"
 	"github.com/piger/sensor-probe/internal/homekit"
 	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
 	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
 )
@@ -26,6 +21,24 @@ import (
 // https://github.com/atc1441/ATC_MiThermometer#advertising-format-of-the-custom-firmware
 const UUID = 0x181a
 
+// Firmware is the name of the atc1441 "custom" advertising format in the configuration file.
+const Firmware = "custom"
+
+// payloadSize is the size of the atc1441 service data, including the UUID; the pvvx firmware
+// uses the same UUID with a longer payload.
+const payloadSize = 15
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter:      filter.ByAdData(hci.AdServiceData, []byte{0x1a, 0x18}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewMijiaSensor(config, id), nil
+		},
+	})
+}
+
 type payload struct {
 	UUID         uint16
 	MAC          [6]uint8
@@ -65,7 +78,6 @@ func checkReport(r *hci.AdStructure) bool {
 
 type MijiaSensor struct {
 	*sensors.Sensor
-	LastData *Data
 }
 
 func NewMijiaSensor(config *config.SensorConfig, id uint64) *MijiaSensor {
@@ -81,20 +93,15 @@ func NewMijiaSensor(config *config.SensorConfig, id uint64) *MijiaSensor {
 	s := sensors.NewSensor(config, acc)
 
 	ms := MijiaSensor{
-		Sensor:   s,
-		LastData: nil,
+		Sensor: s,
 	}
 	return &ms
 }
 
-func (m *MijiaSensor) GetName() string {
-	return m.Name
-}
-
 func (m *MijiaSensor) Update(report *host.ScanReport) error {
 	for _, ads := range report.Data {
-		if checkReport(ads) {
-			if err := m.handleBroadcast(ads); err != nil {
+		if checkReport(ads) && len(ads.Data) == payloadSize {
+			if err := m.handleBroadcast(report, ads); err != nil {
 				log.Print(err)
 			}
 		}
@@ -102,54 +109,17 @@ func (m *MijiaSensor) Update(report *host.ScanReport) error {
 	return nil
 }
 
-func (m *MijiaSensor) handleBroadcast(msg *hci.AdStructure) error {
+func (m *MijiaSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
 	data, err := parseMessage(msg.Data)
 	if err != nil {
 		return err
 	}
-	m.LastData = data
 
-	now := time.Now()
-	// log.Printf("%q (%s): T=%.2f H=%.2f%% B=%d%%", m.Name, m.MAC, data.Temperature, data.Humidity, data.Battery)
-
-	if m.LastUpdateHomeKit.IsZero() || now.Sub(m.LastUpdateHomeKit) >= sensors.HomeKitUpdateInterval {
-		m.SetTemperature(float64(data.Temperature))
-		m.SetHumidity(float64(data.Humidity))
-		m.LastUpdateHomeKit = now
-	}
-
-	return nil
-}
-
-var columnNames = []string{
-	"time",
-	"room",
-	"temperature",
-	"humidity",
-	"battery",
-}
-
-func (m *MijiaSensor) Push(ctx context.Context, pool *pgxpool.Pool, t time.Time) error {
-	if m.LastData == nil {
-		return errors.New("no last data")
-	}
-
-	ctx, cancel := context.WithTimeout(ctx, db.DBConnTimeout)
-	defer cancel()
-
-	columns := db.MakeColumnString(columnNames)
-	values := db.MakeValuesString(columnNames)
-
-	if _, err := pool.Exec(ctx,
-		fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", m.DBTable, columns, values),
-		t,
-		m.Name,
-		m.LastData.Temperature,
-		m.LastData.Humidity,
-		m.LastData.Battery,
-	); err != nil {
-		return fmt.Errorf("error writing row to DB: %w", err)
-	}
+	r := m.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	m.Record(r)
 
 	return nil
 }
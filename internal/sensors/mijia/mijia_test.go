@@ -0,0 +1,94 @@
+package mijia
+
+import (
+	"math"
+	"testing"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Service data of the two custom formats, including the UUID.
+const (
+	// 23.5 °C, 50 %, 90 %, 3000 mV, frame 7
+	atc1441Frame = "\x1a\x18\xa4\xc1\x38\x33\x22\x11\x00\xeb\x32\x5a\x0b\xb8\x07"
+	// 23.45 °C, 50.12 %, 87 %, 2950 mV, frame 12, reed switch and trigger control
+	pvvxFrame = "\x1a\x18\x11\x22\x33\x38\xc1\xa4\x29\x09\x94\x13\x86\x0b\x57\x0c\x05"
+)
+
+func TestParseMessage(t *testing.T) {
+	got, err := parseMessage([]byte(atc1441Frame))
+	if err != nil {
+		t.Fatalf("parseMessage: %s", err)
+	}
+	want := Data{Temperature: 23.5, Humidity: 50, Battery: 90, BatteryVolt: 3000}
+	if *got != want {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+}
+
+func checkMeasurement(t *testing.T, r *sensors.Reading, q sensors.Quantity, want float64) {
+	t.Helper()
+	if m, ok := r.Get(q); !ok || math.Abs(m.Value-want) > 0.001 {
+		t.Errorf("%s = %+v, want %v", q, m, want)
+	}
+}
+
+// The two formats share the service UUID, so each driver must only decode the payloads with
+// its own length.
+func TestUpdateDispatch(t *testing.T) {
+	report := func(payload string) *host.ScanReport {
+		return &host.ScanReport{
+			Data: []*hci.AdStructure{{Typ: hci.AdServiceData, Data: []byte(payload)}},
+		}
+	}
+
+	t.Run("atc1441", func(t *testing.T) {
+		ms := NewMijiaSensor(&config.SensorConfig{Name: "atc", Firmware: Firmware}, 1)
+
+		if err := ms.Update(report(pvvxFrame)); err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		if r := ms.GetLastReading(); r != nil {
+			t.Fatalf("pvvx payload decoded as atc1441: %+v", r)
+		}
+
+		if err := ms.Update(report(atc1441Frame)); err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		r := ms.GetLastReading()
+		if r == nil {
+			t.Fatal("no reading recorded")
+		}
+		checkMeasurement(t, r, sensors.Temperature, 23.5)
+		checkMeasurement(t, r, sensors.Humidity, 50)
+		checkMeasurement(t, r, sensors.Battery, 90)
+	})
+
+	t.Run("pvvx", func(t *testing.T) {
+		ps := NewPvvxSensor(&config.SensorConfig{Name: "pvvx", Firmware: PvvxFirmware}, 1)
+
+		if err := ps.Update(report(atc1441Frame)); err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		if r := ps.GetLastReading(); r != nil {
+			t.Fatalf("atc1441 payload decoded as pvvx: %+v", r)
+		}
+
+		if err := ps.Update(report(pvvxFrame)); err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+		r := ps.GetLastReading()
+		if r == nil {
+			t.Fatal("no reading recorded")
+		}
+		checkMeasurement(t, r, sensors.Temperature, 23.45)
+		checkMeasurement(t, r, sensors.Humidity, 50.12)
+		checkMeasurement(t, r, sensors.Voltage, 2950)
+		checkMeasurement(t, r, sensors.ReedSwitch, 1)
+		checkMeasurement(t, r, sensors.TriggerOutput, 0)
+		checkMeasurement(t, r, sensors.TriggerControl, 1)
+	})
+}
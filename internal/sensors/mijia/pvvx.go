@@ -0,0 +1,154 @@
+// Xiaomi Thermometer LYWSD03MMC running the pvvx custom firmware
+// https://github.com/pvvx/ATC_MiThermometer#custom-format-all-data-little-endian
+
+package mijia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// PvvxFirmware is the name of the pvvx "custom" advertising format in the configuration file.
+const PvvxFirmware = "pvvx"
+
+// pvvxPayloadSize is the size of the pvvx service data, including the UUID.
+const pvvxPayloadSize = 17
+
+// Bits of the pvvx flags byte.
+const (
+	pvvxFlagReedSwitch         = 1 << 0
+	pvvxFlagTriggerOutput      = 1 << 1
+	pvvxFlagTriggerControl     = 1 << 2
+	pvvxFlagTemperatureTrigger = 1 << 3
+	pvvxFlagHumidityTrigger    = 1 << 4
+)
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    PvvxFirmware,
+		AddressType: hci.LePublicAddress,
+		Filter:      filter.ByAdData(hci.AdServiceData, []byte{0x1a, 0x18}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewPvvxSensor(config, id), nil
+		},
+	})
+}
+
+// all the fields are little endian.
+type pvvxPayload struct {
+	UUID         uint16
+	MAC          [6]uint8 // reversed
+	Temperature  int16    // 0.01 °C
+	Humidity     uint16   // 0.01 %
+	BatterymVolt uint16
+	Battery      uint8
+	FrameCounter uint8
+	Flags        uint8
+}
+
+type PvvxData struct {
+	Temperature        float32
+	Humidity           float32
+	Battery            uint16
+	BatteryVolt        float32
+	FrameCounter       uint8
+	ReedSwitch         bool
+	TriggerOutput      bool
+	TriggerControl     bool
+	TemperatureTrigger bool
+	HumidityTrigger    bool
+}
+
+func parsePvvxMessage(b []byte) (*PvvxData, error) {
+	if len(b) != pvvxPayloadSize {
+		return nil, fmt.Errorf("wrong pvvx payload size: %d", len(b))
+	}
+
+	var p pvvxPayload
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &p); err != nil {
+		return nil, err
+	}
+
+	data := PvvxData{
+		Temperature:        float32(p.Temperature) / 100.0,
+		Humidity:           float32(p.Humidity) / 100.0,
+		Battery:            uint16(p.Battery),
+		BatteryVolt:        float32(p.BatterymVolt),
+		FrameCounter:       p.FrameCounter,
+		ReedSwitch:         p.Flags&pvvxFlagReedSwitch != 0,
+		TriggerOutput:      p.Flags&pvvxFlagTriggerOutput != 0,
+		TriggerControl:     p.Flags&pvvxFlagTriggerControl != 0,
+		TemperatureTrigger: p.Flags&pvvxFlagTemperatureTrigger != 0,
+		HumidityTrigger:    p.Flags&pvvxFlagHumidityTrigger != 0,
+	}
+	return &data, nil
+}
+
+func checkPvvxReport(r *hci.AdStructure) bool {
+	return checkReport(r) && len(r.Data) == pvvxPayloadSize
+}
+
+type PvvxSensor struct {
+	*sensors.Sensor
+}
+
+func NewPvvxSensor(config *config.SensorConfig, id uint64) *PvvxSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "Xiaomi Thermometer LYWSD03MMC (pvvx)",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "Xiaomi",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	ps := PvvxSensor{
+		Sensor: s,
+	}
+	return &ps
+}
+
+func (p *PvvxSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkPvvxReport(ads) {
+			if err := p.handleBroadcast(report, ads); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PvvxSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	data, err := parsePvvxMessage(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	r := p.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	r.Add(sensors.Voltage, sensors.UnitMillivolt, float64(data.BatteryVolt))
+	r.AddBool(sensors.ReedSwitch, data.ReedSwitch)
+	r.AddBool(sensors.TriggerOutput, data.TriggerOutput)
+	r.AddBool(sensors.TriggerControl, data.TriggerControl)
+	r.AddBool(sensors.TemperatureTrigger, data.TemperatureTrigger)
+	r.AddBool(sensors.HumidityTrigger, data.HumidityTrigger)
+	p.Record(r)
+
+	return nil
+}
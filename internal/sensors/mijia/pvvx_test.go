@@ -0,0 +1,75 @@
+package mijia
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParsePvvxMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    PvvxData
+	}{
+		{
+			name: "reed switch and trigger control",
+			// 23.45 °C, 50.12 %, 2950 mV, 87 %, frame 12, flags 0x05
+			payload: "\x1a\x18\x11\x22\x33\x38\xc1\xa4\x29\x09\x94\x13\x86\x0b\x57\x0c\x05",
+			want: PvvxData{
+				Temperature:    23.45,
+				Humidity:       50.12,
+				Battery:        87,
+				BatteryVolt:    2950,
+				FrameCounter:   12,
+				ReedSwitch:     true,
+				TriggerControl: true,
+			},
+		},
+		{
+			name: "negative temperature and triggers",
+			// -5.12 °C, 99.99 %, 2500 mV, 10 %, frame 255, flags 0x1a
+			payload: "\x1a\x18\x11\x22\x33\x38\xc1\xa4\x00\xfe\x0f\x27\xc4\x09\x0a\xff\x1a",
+			want: PvvxData{
+				Temperature:        -5.12,
+				Humidity:           99.99,
+				Battery:            10,
+				BatteryVolt:        2500,
+				FrameCounter:       255,
+				TriggerOutput:      true,
+				TemperatureTrigger: true,
+				HumidityTrigger:    true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePvvxMessage([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("parsePvvxMessage: %s", err)
+			}
+			if math.Abs(float64(got.Temperature-tt.want.Temperature)) > 0.001 ||
+				math.Abs(float64(got.Humidity-tt.want.Humidity)) > 0.001 {
+				t.Errorf("got %.2f °C %.2f %%, want %.2f °C %.2f %%",
+					got.Temperature, got.Humidity, tt.want.Temperature, tt.want.Humidity)
+			}
+			got.Temperature, got.Humidity = tt.want.Temperature, tt.want.Humidity
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePvvxMessageSize(t *testing.T) {
+	payload := pvvxFrame
+
+	for _, size := range []int{0, payloadSize, pvvxPayloadSize - 1} {
+		if _, err := parsePvvxMessage([]byte(payload[:size])); err == nil {
+			t.Errorf("parsePvvxMessage accepted a %d bytes payload", size)
+		}
+	}
+	if _, err := parsePvvxMessage([]byte(payload + "\x00")); err == nil {
+		t.Errorf("parsePvvxMessage accepted a %d bytes payload", pvvxPayloadSize+1)
+	}
+}
@@ -0,0 +1,142 @@
+package sensors
+
+import (
+	"time"
+
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Quantity is something measured by a sensor; its name is also the name of the database column
+// where its values are stored, unless the sensor maps it to a different column.
+type Quantity string
+
+const (
+	Temperature        Quantity = "temperature"
+	Humidity           Quantity = "humidity"
+	Battery            Quantity = "battery"
+	Voltage            Quantity = "voltage"
+	Pressure           Quantity = "pressure"
+	Illuminance        Quantity = "illuminance"
+	Moisture           Quantity = "moisture"
+	Conductivity       Quantity = "conductivity"
+	CO2                Quantity = "co2"
+	CO2Status          Quantity = "co2_status"
+	PM1                Quantity = "pm1_0"
+	PM25               Quantity = "pm2_5"
+	PM4                Quantity = "pm4_0"
+	PM10               Quantity = "pm10"
+	VOC                Quantity = "voc"
+	NOx                Quantity = "nox"
+	TxPower            Quantity = "txpower"
+	AccelerationX      Quantity = "acceleration_x"
+	AccelerationY      Quantity = "acceleration_y"
+	AccelerationZ      Quantity = "acceleration_z"
+	MovementCounter    Quantity = "movement_counter"
+	Sequence           Quantity = "sequence"
+	ReedSwitch         Quantity = "reed_switch"
+	TriggerOutput      Quantity = "trigger_output"
+	TriggerControl     Quantity = "trigger_control"
+	TemperatureTrigger Quantity = "temperature_trigger"
+	HumidityTrigger    Quantity = "humidity_trigger"
+	Motion             Quantity = "motion"
+	Window             Quantity = "window"
+	Button             Quantity = "button"
+)
+
+// Unit is the unit of measurement of a value.
+type Unit string
+
+const (
+	UnitNone                    Unit = ""
+	UnitCelsius                 Unit = "°C"
+	UnitPercent                 Unit = "%"
+	UnitPascal                  Unit = "Pa"
+	UnitHectoPascal             Unit = "hPa"
+	UnitMillivolt               Unit = "mV"
+	UnitVolt                    Unit = "V"
+	UnitLux                     Unit = "lx"
+	UnitMicroSiemensPerCm       Unit = "µS/cm"
+	UnitPPM                     Unit = "ppm"
+	UnitMicrogramsPerCubicMeter Unit = "µg/m³"
+	UnitDBm                     Unit = "dBm"
+	UnitG                       Unit = "g"
+
+	// UnitBoolean marks the values that are either 0 (false) or 1 (true).
+	UnitBoolean Unit = "bool"
+)
+
+// Measurement is a single value measured by a sensor.
+type Measurement struct {
+	Quantity Quantity
+	Unit     Unit
+	Value    float64
+}
+
+// Bool returns the value of a boolean measurement.
+func (m Measurement) Bool() bool {
+	return m.Value != 0
+}
+
+// Reading is the set of values measured by a sensor at a given time; readings are produced by
+// the drivers and consumed by HomeKit and by the database.
+type Reading struct {
+	Time         time.Time
+	Name         string
+	MAC          string
+	Firmware     string
+	RSSI         int8 // dBm
+	Measurements []Measurement
+}
+
+// Add appends a measurement to the reading.
+func (r *Reading) Add(q Quantity, unit Unit, v float64) {
+	r.Measurements = append(r.Measurements, Measurement{Quantity: q, Unit: unit, Value: v})
+}
+
+// AddBool appends a boolean measurement to the reading.
+func (r *Reading) AddBool(q Quantity, v bool) {
+	var n float64
+	if v {
+		n = 1
+	}
+	r.Add(q, UnitBoolean, n)
+}
+
+// Get returns the measurement of a quantity, if the reading has one.
+func (r *Reading) Get(q Quantity) (Measurement, bool) {
+	for _, m := range r.Measurements {
+		if m.Quantity == q {
+			return m, true
+		}
+	}
+	return Measurement{}, false
+}
+
+type number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~float32 | ~float64
+}
+
+// AddOptional appends a measurement to the reading, unless the value is nil.
+func AddOptional[T number](r *Reading, q Quantity, unit Unit, v *T) {
+	if v != nil {
+		r.Add(q, unit, float64(*v))
+	}
+}
+
+// AddOptionalBool appends a boolean measurement to the reading, unless the value is nil.
+func AddOptionalBool(r *Reading, q Quantity, v *bool) {
+	if v != nil {
+		r.AddBool(q, *v)
+	}
+}
+
+// NewReading returns an empty reading of the sensor for a scan report.
+func (s *Sensor) NewReading(report *host.ScanReport) *Reading {
+	return &Reading{
+		Time:     time.Now(),
+		Name:     s.Name,
+		MAC:      s.MAC,
+		Firmware: s.Firmware,
+		RSSI:     report.Rssi,
+	}
+}
@@ -0,0 +1,107 @@
+package sensors
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+)
+
+// Driver describes a family of sensors sharing the same advertising format; drivers register
+// themselves with Register from an init() function, much like database/sql drivers do.
+type Driver struct {
+	// Firmware is the name used in the "firmware" setting of a sensor configuration.
+	Firmware string
+
+	// AddressType is the type of Bluetooth address used by the sensors (public or random).
+	AddressType hci.BtAddressType
+
+	// Filter matches the advertisements broadcast by this kind of sensor.
+	Filter filter.AdFilter
+
+	// SensorFilter returns the address type and the filter of a single sensor, for the drivers
+	// whose advertising format is described in the sensor configuration; when set it takes the
+	// place of AddressType and Filter.
+	SensorFilter func(*config.SensorConfig) (hci.BtAddressType, filter.AdFilter, error)
+
+	// Validate performs driver specific checks on a sensor configuration; it can be nil.
+	Validate func(*config.SensorConfig) error
+
+	// New creates a new sensor; id is the HomeKit accessory ID.
+	New func(config *config.SensorConfig, id uint64) (SensorUpdater, error)
+
+	// Table is the table of doc/schema.sql with the columns written by the sensors; the database
+	// sinks create the tables of the sensors with its columns. It defaults to DefaultTable.
+	Table string
+}
+
+// DefaultTable is the table of doc/schema.sql shared by most drivers.
+const DefaultTable = "home_temperature"
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]*Driver)
+)
+
+// Register makes a sensor driver available under its firmware name. It panics if the driver
+// is incomplete or if a driver with the same firmware name was already registered.
+func Register(d *Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if d == nil || d.Firmware == "" || (d.Filter == nil && d.SensorFilter == nil) || d.New == nil {
+		panic("sensors: Register called with an incomplete driver")
+	}
+	if _, dup := drivers[d.Firmware]; dup {
+		panic("sensors: Register called twice for firmware " + d.Firmware)
+	}
+	drivers[d.Firmware] = d
+}
+
+// Lookup returns the driver registered for the given firmware name.
+func Lookup(firmware string) (*Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	d, ok := drivers[firmware]
+	if !ok {
+		return nil, fmt.Errorf("unsupported firmware %q (supported: %v)", firmware, firmwares())
+	}
+	return d, nil
+}
+
+// FilterFor returns the address type and the advertisements filter of a sensor using this driver.
+func (d *Driver) FilterFor(sc *config.SensorConfig) (hci.BtAddressType, filter.AdFilter, error) {
+	if d.SensorFilter != nil {
+		return d.SensorFilter(sc)
+	}
+	return d.AddressType, d.Filter, nil
+}
+
+// SchemaTable returns the table of doc/schema.sql with the columns written by the sensors.
+func (d *Driver) SchemaTable() string {
+	if d.Table == "" {
+		return DefaultTable
+	}
+	return d.Table
+}
+
+// Firmwares returns the sorted list of the registered firmware names.
+func Firmwares() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	return firmwares()
+}
+
+func firmwares() []string {
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,300 @@
+package ruuvi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Data formats; see https://docs.ruuvi.com/communication/bluetooth-advertisements
+const (
+	FormatRAWv1    = 0x03
+	FormatRAWv2    = 0x05
+	FormatAir      = 0x06
+	FormatExtended = 0xe1
+)
+
+// Data holds the measurements decoded from a Ruuvi advertisement; the fields missing from the
+// data format, or holding the "not available" value, are nil.
+type Data struct {
+	Format        int
+	Invalid       []string // names of the fields that were set to "not available" by the tag
+	Temperature   *float32
+	Humidity      *float32
+	Pressure      *int // Pa
+	AccelerationX *float32
+	AccelerationY *float32
+	AccelerationZ *float32
+	Voltage       *int // mV
+	TxPower       *int // dBm
+	MoveCount     *int
+	Seq           *int
+	PM1           *float32 // µg/m³
+	PM25          *float32 // µg/m³
+	PM4           *float32 // µg/m³
+	PM10          *float32 // µg/m³
+	CO2           *int     // ppm
+	VOC           *int     // index
+	NOx           *int     // index
+	Luminosity    *float32 // lux
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// checked returns a pointer to v when valid is true; otherwise it records name among the invalid
+// fields of d and returns nil.
+func checked[T any](d *Data, name string, valid bool, v T) *T {
+	if !valid {
+		d.Invalid = append(d.Invalid, name)
+		return nil
+	}
+	return &v
+}
+
+// RAWv1 format
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-3-rawv1
+type payloadV3 struct {
+	UUID            uint16 // 0x0499, manufacturer ID
+	Format          uint8
+	Humidity        uint8 // 0.5%
+	TemperatureInt  uint8 // MSB is the sign, followed by the integer part
+	TemperatureFrac uint8 // 1/100
+	Pressure        uint16
+	AccelerationX   int16
+	AccelerationY   int16
+	AccelerationZ   int16
+	Voltage         uint16
+}
+
+// RAWv2 format
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
+type payloadV5 struct {
+	UUID            uint16 // 0x0499, manufacturer ID
+	Format          uint8
+	Temperature     int16
+	Humidity        uint16
+	Pressure        uint16
+	AccelerationX   int16
+	AccelerationY   int16
+	AccelerationZ   int16
+	PowerInfo       uint16 // it's composed
+	MovementCounter uint8
+	Sequence        uint16
+	MAC             [6]uint8
+}
+
+// Ruuvi Air format, compatible with Bluetooth 4
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-6
+type payloadV6 struct {
+	UUID        uint16 // 0x0499, manufacturer ID
+	Format      uint8
+	Temperature int16
+	Humidity    uint16
+	Pressure    uint16
+	PM25        uint16
+	CO2         uint16
+	VOC         uint8 // bits 9..2, the LSB is in Flags
+	NOx         uint8 // bits 9..2, the LSB is in Flags
+	Luminosity  uint8 // logarithmic
+	Reserved    uint8
+	Sequence    uint8
+	Flags       uint8
+	MAC         [3]uint8
+}
+
+// Ruuvi Air extended format, Bluetooth 5 only
+// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-e1
+type payloadE1 struct {
+	UUID        uint16 // 0x0499, manufacturer ID
+	Format      uint8
+	Temperature int16
+	Humidity    uint16
+	Pressure    uint16
+	PM1         uint16
+	PM25        uint16
+	PM4         uint16
+	PM10        uint16
+	CO2         uint16
+	VOC         uint8 // bits 9..2, the LSB is in Flags
+	NOx         uint8 // bits 9..2, the LSB is in Flags
+	Luminosity  [3]uint8
+	Reserved1   [3]uint8
+	Sequence    [3]uint8
+	Flags       uint8
+	Reserved2   [5]uint8
+	MAC         [6]uint8
+}
+
+// Values used by the tags to signal that a measurement is not available.
+const (
+	invalidInt16     = -0x8000
+	invalidUint8     = 0xff
+	invalidUint16    = 0xffff
+	invalidUint24    = 0xffffff
+	invalidVoltage   = 0x7ff
+	invalidTxPower   = 0x1f
+	invalidAirIndex  = 0x1ff
+	invalidLuxLogAir = 0xff
+)
+
+// Bits of the Ruuvi Air flags byte holding the least significant bits of the VOC and NOx indexes.
+const (
+	flagNOxLSB = 1 << 6
+	flagVOCLSB = 1 << 7
+)
+
+func uint24(b [3]uint8) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// airIndex rebuilds a 9 bits VOC or NOx index from its 8 most significant bits and the flag
+// holding its least significant bit.
+func airIndex(msb uint8, flags uint8, lsbFlag uint8) int {
+	idx := int(msb) << 1
+	if flags&lsbFlag != 0 {
+		idx |= 1
+	}
+	return idx
+}
+
+// parseMessage decodes a Ruuvi advertisement, including the manufacturer ID, dispatching on
+// its data format.
+func parseMessage(b []byte) (*Data, error) {
+	if len(b) < 3 {
+		return nil, errors.New("ruuvi message too short")
+	}
+
+	switch b[2] {
+	case FormatRAWv1:
+		return parseRAWv1(b)
+	case FormatRAWv2:
+		return parseRAWv2(b)
+	case FormatAir:
+		return parseAir(b)
+	case FormatExtended:
+		return parseExtended(b)
+	}
+
+	return nil, fmt.Errorf("wrong data format: %d", b[2])
+}
+
+func parseRAWv1(b []byte) (*Data, error) {
+	var p payloadV3
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &p); err != nil {
+		return nil, err
+	}
+
+	temperature := float32(p.TemperatureInt&0x7f) + float32(p.TemperatureFrac)/100
+	if p.TemperatureInt&0x80 != 0 {
+		temperature = -temperature
+	}
+
+	data := Data{
+		Format:        FormatRAWv1,
+		Temperature:   ptr(temperature),
+		Humidity:      ptr(float32(p.Humidity) * 0.5),
+		Pressure:      ptr(int(p.Pressure) + 50000),
+		AccelerationX: ptr(float32(p.AccelerationX) / 1000),
+		AccelerationY: ptr(float32(p.AccelerationY) / 1000),
+		AccelerationZ: ptr(float32(p.AccelerationZ) / 1000),
+		Voltage:       ptr(int(p.Voltage)),
+	}
+
+	return &data, nil
+}
+
+func parseRAWv2(b []byte) (*Data, error) {
+	var p payloadV5
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &p); err != nil {
+		return nil, err
+	}
+
+	// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
+	//
+	// Power info (11+5bit unsigned), first 11 bits is the battery voltage above 1.6V, in millivolts
+	// (1.6V to 3.646V range). Last 5 bits unsigned are the TX power above -40dBm, in 2dBm steps.
+	// (-40dBm to +20dBm range)
+	//
+	// 0xFFFF = 0b1111111111111111 (16 bits)
+	// 0xFFE0 = 0b1111111111100000
+	// 0x001F = 0b11111
+	//
+	// Do a bitwise AND to keep the first 11 bits and set the others to 0,
+	// then shift by 5 bits.
+	voltageBits := (p.PowerInfo & 0xFFE0) >> 5
+	txPowerBits := (p.PowerInfo & 0x001F)
+
+	// XXX need to compare Voltage and TxPower with bluewalker, to see if I'm parsing correctly
+	data := Data{Format: FormatRAWv2}
+	data.Temperature = checked(&data, "temperature", p.Temperature != invalidInt16, float32(p.Temperature)*0.005)
+	data.Humidity = checked(&data, "humidity", p.Humidity != invalidUint16, float32(p.Humidity)*0.0025)
+	data.Pressure = checked(&data, "pressure", p.Pressure != invalidUint16, int(p.Pressure)+50000)
+	data.AccelerationX = checked(&data, "acceleration_x", p.AccelerationX != invalidInt16, float32(p.AccelerationX)/1000)
+	data.AccelerationY = checked(&data, "acceleration_y", p.AccelerationY != invalidInt16, float32(p.AccelerationY)/1000)
+	data.AccelerationZ = checked(&data, "acceleration_z", p.AccelerationZ != invalidInt16, float32(p.AccelerationZ)/1000)
+	data.Voltage = checked(&data, "voltage", voltageBits != invalidVoltage, 1600+int(voltageBits))
+	data.TxPower = checked(&data, "txpower", txPowerBits != invalidTxPower, -40+int(txPowerBits)*2)
+	data.MoveCount = checked(&data, "movement_counter", p.MovementCounter != invalidUint8, int(p.MovementCounter))
+	data.Seq = checked(&data, "sequence", p.Sequence != invalidUint16, int(p.Sequence))
+
+	return &data, nil
+}
+
+// luminosityDelta is the step of the logarithmic luminosity scale of the Ruuvi Air format.
+var luminosityDelta = math.Log(65535+1) / 254
+
+func parseAir(b []byte) (*Data, error) {
+	var p payloadV6
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &p); err != nil {
+		return nil, err
+	}
+
+	voc := airIndex(p.VOC, p.Flags, flagVOCLSB)
+	nox := airIndex(p.NOx, p.Flags, flagNOxLSB)
+
+	data := Data{Format: FormatAir}
+	data.Temperature = checked(&data, "temperature", p.Temperature != invalidInt16, float32(p.Temperature)*0.005)
+	data.Humidity = checked(&data, "humidity", p.Humidity != invalidUint16, float32(p.Humidity)*0.0025)
+	data.Pressure = checked(&data, "pressure", p.Pressure != invalidUint16, int(p.Pressure)+50000)
+	data.PM25 = checked(&data, "pm2_5", p.PM25 != invalidUint16, float32(p.PM25)*0.1)
+	data.CO2 = checked(&data, "co2", p.CO2 != invalidUint16, int(p.CO2))
+	data.VOC = checked(&data, "voc", voc != invalidAirIndex, voc)
+	data.NOx = checked(&data, "nox", nox != invalidAirIndex, nox)
+	data.Luminosity = checked(&data, "luminosity", p.Luminosity != invalidLuxLogAir,
+		float32(math.Exp(float64(p.Luminosity)*luminosityDelta)-1))
+	data.Seq = checked(&data, "sequence", p.Sequence != invalidUint8, int(p.Sequence))
+
+	return &data, nil
+}
+
+func parseExtended(b []byte) (*Data, error) {
+	var p payloadE1
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &p); err != nil {
+		return nil, err
+	}
+
+	voc := airIndex(p.VOC, p.Flags, flagVOCLSB)
+	nox := airIndex(p.NOx, p.Flags, flagNOxLSB)
+	luminosity := uint24(p.Luminosity)
+	sequence := uint24(p.Sequence)
+
+	data := Data{Format: FormatExtended}
+	data.Temperature = checked(&data, "temperature", p.Temperature != invalidInt16, float32(p.Temperature)*0.005)
+	data.Humidity = checked(&data, "humidity", p.Humidity != invalidUint16, float32(p.Humidity)*0.0025)
+	data.Pressure = checked(&data, "pressure", p.Pressure != invalidUint16, int(p.Pressure)+50000)
+	data.PM1 = checked(&data, "pm1_0", p.PM1 != invalidUint16, float32(p.PM1)*0.1)
+	data.PM25 = checked(&data, "pm2_5", p.PM25 != invalidUint16, float32(p.PM25)*0.1)
+	data.PM4 = checked(&data, "pm4_0", p.PM4 != invalidUint16, float32(p.PM4)*0.1)
+	data.PM10 = checked(&data, "pm10", p.PM10 != invalidUint16, float32(p.PM10)*0.1)
+	data.CO2 = checked(&data, "co2", p.CO2 != invalidUint16, int(p.CO2))
+	data.VOC = checked(&data, "voc", voc != invalidAirIndex, voc)
+	data.NOx = checked(&data, "nox", nox != invalidAirIndex, nox)
+	data.Luminosity = checked(&data, "luminosity", luminosity != invalidUint24, float32(luminosity)*0.01)
+	data.Seq = checked(&data, "sequence", sequence != invalidUint24, int(sequence))
+
+	return &data, nil
+}
@@ -0,0 +1,254 @@
+package ruuvi
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// fields returns the values set in d, by name.
+func fields(d *Data) map[string]float64 {
+	result := make(map[string]float64)
+	set := func(name string, v interface{}) {
+		switch v := v.(type) {
+		case *float32:
+			if v != nil {
+				result[name] = float64(*v)
+			}
+		case *int:
+			if v != nil {
+				result[name] = float64(*v)
+			}
+		}
+	}
+
+	set("temperature", d.Temperature)
+	set("humidity", d.Humidity)
+	set("pressure", d.Pressure)
+	set("acceleration_x", d.AccelerationX)
+	set("acceleration_y", d.AccelerationY)
+	set("acceleration_z", d.AccelerationZ)
+	set("voltage", d.Voltage)
+	set("txpower", d.TxPower)
+	set("movement_counter", d.MoveCount)
+	set("sequence", d.Seq)
+	set("pm1_0", d.PM1)
+	set("pm2_5", d.PM25)
+	set("pm4_0", d.PM4)
+	set("pm10", d.PM10)
+	set("co2", d.CO2)
+	set("voc", d.VOC)
+	set("nox", d.NOx)
+	set("luminosity", d.Luminosity)
+	return result
+}
+
+// The test vectors published with the Ruuvi data formats documentation; the minimum, maximum and
+// invalid vectors of formats 6 and E1 are built from the ranges of the specification.
+var formatTests = []struct {
+	name    string
+	payload string // without the manufacturer ID
+	format  int
+	want    map[string]float64
+	invalid []string
+}{
+	{
+		name:    "RAWv1 valid",
+		payload: "03291A1ECE1EFC18F94202CA0B53",
+		format:  FormatRAWv1,
+		want: map[string]float64{
+			"temperature": 26.3, "humidity": 20.5, "pressure": 102766,
+			"acceleration_x": -1, "acceleration_y": -1.726, "acceleration_z": 0.714, "voltage": 2899,
+		},
+	},
+	{
+		name:    "RAWv1 maximum",
+		payload: "03FF7F63FFFF7FFF7FFF7FFFFFFF",
+		format:  FormatRAWv1,
+		want: map[string]float64{
+			"temperature": 127.99, "humidity": 127.5, "pressure": 115535,
+			"acceleration_x": 32.767, "acceleration_y": 32.767, "acceleration_z": 32.767, "voltage": 65535,
+		},
+	},
+	{
+		name:    "RAWv1 minimum",
+		payload: "0300FF6300008001800180010000",
+		format:  FormatRAWv1,
+		want: map[string]float64{
+			"temperature": -127.99, "humidity": 0, "pressure": 50000,
+			"acceleration_x": -32.767, "acceleration_y": -32.767, "acceleration_z": -32.767, "voltage": 0,
+		},
+	},
+	{
+		name:    "RAWv2 valid",
+		payload: "0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F",
+		format:  FormatRAWv2,
+		want: map[string]float64{
+			"temperature": 24.3, "humidity": 53.49, "pressure": 100044,
+			"acceleration_x": 0.004, "acceleration_y": -0.004, "acceleration_z": 1.036,
+			"voltage": 2977, "txpower": 4, "movement_counter": 66, "sequence": 205,
+		},
+	},
+	{
+		name:    "RAWv2 maximum",
+		payload: "057FFFFFFEFFFE7FFF7FFF7FFFFFDEFEFFFECBB8334C884F",
+		format:  FormatRAWv2,
+		want: map[string]float64{
+			"temperature": 163.835, "humidity": 163.835, "pressure": 115534,
+			"acceleration_x": 32.767, "acceleration_y": 32.767, "acceleration_z": 32.767,
+			"voltage": 3646, "txpower": 20, "movement_counter": 254, "sequence": 65534,
+		},
+	},
+	{
+		name:    "RAWv2 minimum",
+		payload: "058001000000008001800180010000000000CBB8334C884F",
+		format:  FormatRAWv2,
+		want: map[string]float64{
+			"temperature": -163.835, "humidity": 0, "pressure": 50000,
+			"acceleration_x": -32.767, "acceleration_y": -32.767, "acceleration_z": -32.767,
+			"voltage": 1600, "txpower": -40, "movement_counter": 0, "sequence": 0,
+		},
+	},
+	{
+		name:    "RAWv2 invalid",
+		payload: "058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF",
+		format:  FormatRAWv2,
+		want:    map[string]float64{},
+		invalid: []string{
+			"temperature", "humidity", "pressure", "acceleration_x", "acceleration_y", "acceleration_z",
+			"voltage", "txpower", "movement_counter", "sequence",
+		},
+	},
+	{
+		name:    "Air valid",
+		payload: "06170C5668C79E007000C90501D900CD004C884F",
+		format:  FormatAir,
+		want: map[string]float64{
+			"temperature": 29.5, "humidity": 55.3, "pressure": 101102, "pm2_5": 11.2, "co2": 201,
+			"voc": 10, "nox": 2, "luminosity": 13026.67, "sequence": 205,
+		},
+	},
+	{
+		name:    "Air maximum",
+		payload: "067FFF9C40FFFE27109C40FAFAFE00FE004C884F",
+		format:  FormatAir,
+		want: map[string]float64{
+			"temperature": 163.835, "humidity": 100, "pressure": 115534, "pm2_5": 1000, "co2": 40000,
+			"voc": 500, "nox": 500, "luminosity": 65535, "sequence": 254,
+		},
+	},
+	{
+		name:    "Air minimum",
+		payload: "068001" + "0000000000000000" + "000000000000" + "4C884F",
+		format:  FormatAir,
+		want: map[string]float64{
+			"temperature": -163.835, "humidity": 0, "pressure": 50000, "pm2_5": 0, "co2": 0,
+			"voc": 0, "nox": 0, "luminosity": 0, "sequence": 0,
+		},
+	},
+	{
+		name:    "Air invalid",
+		payload: "068000FFFFFFFFFFFFFFFFFFFFFFFFFFC04C884F",
+		format:  FormatAir,
+		want:    map[string]float64{},
+		invalid: []string{"temperature", "humidity", "pressure", "pm2_5", "co2", "voc", "nox", "luminosity", "sequence"},
+	},
+	{
+		name:    "E1 valid",
+		payload: "E1170C5668C79E0065007004BD11CA00C90A0213E0ACFFFFFFDECDEE100000000000CBB8334C884F",
+		format:  FormatExtended,
+		want: map[string]float64{
+			"temperature": 29.5, "humidity": 55.3, "pressure": 101102,
+			"pm1_0": 10.1, "pm2_5": 11.2, "pm4_0": 121.3, "pm10": 455.4, "co2": 201,
+			"voc": 20, "nox": 4, "luminosity": 13027, "sequence": 14601710,
+		},
+	},
+	{
+		name:    "E1 maximum",
+		payload: "E17FFF9C40FFFE27102710271027109C40FAFAFFFFFEFFFFFFFFFFFE000000000000CBB8334C884F",
+		format:  FormatExtended,
+		want: map[string]float64{
+			"temperature": 163.835, "humidity": 100, "pressure": 115534,
+			"pm1_0": 1000, "pm2_5": 1000, "pm4_0": 1000, "pm10": 1000, "co2": 40000,
+			"voc": 500, "nox": 500, "luminosity": 167772.14, "sequence": 16777214,
+		},
+	},
+	{
+		name:    "E1 minimum",
+		payload: "E18001" + "00000000000000000000000000000000" + "000000" + "FFFFFF" + "000000" + "00" + "0000000000" + "CBB8334C884F",
+		format:  FormatExtended,
+		want: map[string]float64{
+			"temperature": -163.835, "humidity": 0, "pressure": 50000,
+			"pm1_0": 0, "pm2_5": 0, "pm4_0": 0, "pm10": 0, "co2": 0,
+			"voc": 0, "nox": 0, "luminosity": 0, "sequence": 0,
+		},
+	},
+	{
+		name:    "E1 invalid",
+		payload: "E18000" + "FFFFFFFFFFFFFFFFFFFFFFFFFFFF" + "FFFF" + "FFFFFF" + "FFFFFF" + "FFFFFF" + "C0" + "FFFFFFFFFF" + "FFFFFFFFFFFF",
+		format:  FormatExtended,
+		want:    map[string]float64{},
+		invalid: []string{
+			"temperature", "humidity", "pressure", "pm1_0", "pm2_5", "pm4_0", "pm10", "co2",
+			"voc", "nox", "luminosity", "sequence",
+		},
+	},
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, tt := range formatTests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := hex.DecodeString(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := parseMessage(append([]byte{0x99, 0x04}, payload...))
+			if err != nil {
+				t.Fatalf("parseMessage: %s", err)
+			}
+			if data.Format != tt.format {
+				t.Errorf("format = 0x%02x, want 0x%02x", data.Format, tt.format)
+			}
+
+			got := fields(data)
+			for name, want := range tt.want {
+				v, ok := got[name]
+				if !ok {
+					t.Errorf("%s is missing", name)
+					continue
+				}
+				// the luminosity of format 6 is logarithmic, with a step of about 4.5%.
+				tolerance := 0.001
+				if name == "luminosity" {
+					tolerance = 0.01
+				}
+				if math.Abs(v-want) > tolerance*math.Max(1, math.Abs(want)) {
+					t.Errorf("%s = %v, want %v", name, v, want)
+				}
+			}
+			for name, v := range got {
+				if _, ok := tt.want[name]; !ok {
+					t.Errorf("unexpected %s = %v", name, v)
+				}
+			}
+
+			if !reflect.DeepEqual(data.Invalid, tt.invalid) {
+				t.Errorf("invalid = %v, want %v", data.Invalid, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, payload := range []string{"", "05", "0512FC5394", "06170C5668", "E1170C5668C79E", "0A0102"} {
+		b, err := hex.DecodeString(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseMessage(append([]byte{0x99, 0x04}, b...)); err == nil {
+			t.Errorf("parseMessage(%s) succeeded, want an error", payload)
+		}
+	}
+}
@@ -1,23 +1,17 @@
-// Ruuvi tag
-// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_05.md
+// Ruuvi tag and Ruuvi Air
+// https://docs.ruuvi.com/communication/bluetooth-advertisements
 
 package ruuvi
 
 import (
-	"bytes"
-	"context"
 	"encoding/binary"
-	"errors"
-	"fmt"
 	"log"
-	"time"
 
 	"github.com/brutella/hc/accessory"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/piger/sensor-probe/internal/config"
-	"github.com/piger/sensor-probe/internal/db"
 	"github.com/piger/sensor-probe/internal/homekit"
 	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
 	"gitlab.com/jtaimisto/bluewalker/hci"
 	"gitlab.com/jtaimisto/bluewalker/host"
 )
@@ -25,83 +19,20 @@ import (
 // Manufacturer ID: Ruuvi Innovations Ltd.
 const UUID = 0x0499
 
-// v5 format
-type payload struct {
-	UUID            uint16 // 0x0499, manufacturer ID
-	Format          int8
-	Temperature     int16
-	Humidity        uint16
-	Pressure        uint16
-	AccelerationX   int16
-	AccelerationY   int16
-	AccelerationZ   int16
-	PowerInfo       uint16 // it's composed
-	MovementCounter uint8
-	Sequence        uint16
-	MAC             [6]uint8
-}
-
-type Data struct {
-	Temperature   float32
-	Humidity      float32
-	Pressure      int
-	AccelerationX float32
-	AccelerationY float32
-	AccelerationZ float32
-	Voltage       int
-	TxPower       int
-	MoveCount     int
-	Seq           int
-}
-
-// TODO is the data prefixed by the manufacturer ID?? 0x0499 (2 bytes)
-// and if so should we skip it? how does the mijia parser handle it??
-
-func parseMessage(b []byte) (*Data, error) {
-	var p payload
-	buf := bytes.NewBuffer(b)
-	if err := binary.Read(buf, binary.BigEndian, &p); err != nil {
-		return nil, err
-	}
-
-	if p.Format != 5 {
-		return nil, fmt.Errorf("wrong data format: %d", p.Format)
-	}
-
-	// https://docs.ruuvi.com/communication/bluetooth-advertisements/data-format-5-rawv2
-	//
-	// Power info (11+5bit unsigned), first 11 bits is the battery voltage above 1.6V, in millivolts
-	// (1.6V to 3.646V range). Last 5 bits unsigned are the TX power above -40dBm, in 2dBm steps.
-	// (-40dBm to +20dBm range)
-	//
-	// 0xFFFF = 0b1111111111111111 (16 bits)
-	// 0xFFE0 = 0b1111111111100000
-	// 0x001F = 0b11111
-	//
-	// Do a bitwise AND to keep the first 11 bits and set the others to 0,
-	// then shift by 5 bits.
-	tmp := (p.PowerInfo & 0xFFE0) >> 5
-	voltage := int(1600 + tmp)
-
-	tmp = (p.PowerInfo & 0x001F)
-	txpower := -40 + int((tmp * 2))
-
-	// v5 format
-	// XXX need to compare Voltage and TxPower with bluewalker, to see if I'm parsing correctly
-	data := Data{
-		Temperature:   float32(p.Temperature) * 0.005,
-		Humidity:      float32(p.Humidity) * 0.0025,
-		Pressure:      int(p.Pressure) + 50000,
-		AccelerationX: float32(p.AccelerationX) / 1000,
-		AccelerationY: float32(p.AccelerationY) / 1000,
-		AccelerationZ: float32(p.AccelerationZ) / 1000,
-		Voltage:       voltage,
-		TxPower:       txpower,
-		MoveCount:     int(p.MovementCounter),
-		Seq:           int(p.Sequence),
-	}
-
-	return &data, nil
+// Firmware is the name of the Ruuvi driver in the configuration file; the name is historical,
+// since the driver decodes every data format in use (3, 5, 6 and E1).
+const Firmware = "ruuviv5"
+
+func init() {
+	// RuuviTags use a random static Bluetooth address.
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LeRandomAddress,
+		Filter:      filter.ByVendor([]byte{0x99, 0x04}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewRuuviSensor(config, id), nil
+		},
+	})
 }
 
 func checkReport(r *hci.AdStructure) bool {
@@ -110,13 +41,12 @@ func checkReport(r *hci.AdStructure) bool {
 
 type RuuviSensor struct {
 	*sensors.Sensor
-	LastData *Data
 }
 
 func NewRuuviSensor(config *config.SensorConfig, id uint64) *RuuviSensor {
 	info := accessory.Info{
 		Name:         config.Name,
-		Model:        "RuuviTag 4in1",
+		Model:        "RuuviTag",
 		SerialNumber: "12345",
 		Manufacturer: "Ruuvi",
 		ID:           id,
@@ -124,21 +54,17 @@ func NewRuuviSensor(config *config.SensorConfig, id uint64) *RuuviSensor {
 
 	acc := homekit.NewTemperatureHumiditySensor(info)
 	s := sensors.NewSensor(config, acc)
+	s.Columns = map[sensors.Quantity]string{sensors.Illuminance: "luminosity"}
 	rv := RuuviSensor{
-		Sensor:   s,
-		LastData: nil,
+		Sensor: s,
 	}
 	return &rv
 }
 
-func (rv *RuuviSensor) GetName() string {
-	return rv.Name
-}
-
 func (rv *RuuviSensor) Update(report *host.ScanReport) error {
 	for _, ads := range report.Data {
 		if checkReport(ads) {
-			if err := rv.handleBroadcast(ads); err != nil {
+			if err := rv.handleBroadcast(report, ads); err != nil {
 				log.Print(err)
 			}
 		}
@@ -146,56 +72,38 @@ func (rv *RuuviSensor) Update(report *host.ScanReport) error {
 	return nil
 }
 
-func (rv *RuuviSensor) handleBroadcast(msg *hci.AdStructure) error {
+func (rv *RuuviSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
 	data, err := parseMessage(msg.Data)
 	if err != nil {
 		return err
 	}
-	rv.LastData = data
 
-	now := time.Now()
-	// log.Printf("%q (%s): T=%.2f H=%.2f%% P=%d Tx=%ddBm V=%dV", rv.Name, rv.MAC, data.Temperature, data.Humidity, data.Pressure, data.TxPower, data.Voltage)
-
-	if rv.LastUpdateHomeKit.IsZero() || now.Sub(rv.LastUpdateHomeKit) >= sensors.HomeKitUpdateInterval {
-		rv.SetTemperature(float64(data.Temperature))
-		rv.SetHumidity(float64(data.Humidity))
-		rv.LastUpdateHomeKit = now
+	// the invalid fields are nil, hence written as NULL and not sent to HomeKit.
+	for _, name := range data.Invalid {
+		rv.CountInvalid(name)
 	}
 
-	return nil
-}
-
-var columnNames = []string{
-	"time",
-	"temperature",
-	"humidity",
-	"pressure",
-	"voltage",
-	"txpower",
-}
-
-func (rv *RuuviSensor) Push(ctx context.Context, pool *pgxpool.Pool, t time.Time) error {
-	if rv.LastData == nil {
-		return errors.New("no last data")
-	}
-
-	ctx, cancel := context.WithTimeout(ctx, db.DBConnTimeout)
-	defer cancel()
-
-	columns := db.MakeColumnString(columnNames)
-	values := db.MakeValuesString(columnNames)
-
-	if _, err := pool.Exec(ctx,
-		fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", rv.DBTable, columns, values),
-		t,
-		rv.LastData.Temperature,
-		rv.LastData.Humidity,
-		rv.LastData.Pressure,
-		rv.LastData.Voltage,
-		rv.LastData.TxPower,
-	); err != nil {
-		return fmt.Errorf("error writing row to DB: %w", err)
-	}
+	// the measurements missing from the tag's data format, or not available, are left out.
+	r := rv.NewReading(report)
+	sensors.AddOptional(r, sensors.Temperature, sensors.UnitCelsius, data.Temperature)
+	sensors.AddOptional(r, sensors.Humidity, sensors.UnitPercent, data.Humidity)
+	sensors.AddOptional(r, sensors.Pressure, sensors.UnitPascal, data.Pressure)
+	sensors.AddOptional(r, sensors.Voltage, sensors.UnitMillivolt, data.Voltage)
+	sensors.AddOptional(r, sensors.TxPower, sensors.UnitDBm, data.TxPower)
+	sensors.AddOptional(r, sensors.AccelerationX, sensors.UnitG, data.AccelerationX)
+	sensors.AddOptional(r, sensors.AccelerationY, sensors.UnitG, data.AccelerationY)
+	sensors.AddOptional(r, sensors.AccelerationZ, sensors.UnitG, data.AccelerationZ)
+	sensors.AddOptional(r, sensors.MovementCounter, sensors.UnitNone, data.MoveCount)
+	sensors.AddOptional(r, sensors.Sequence, sensors.UnitNone, data.Seq)
+	sensors.AddOptional(r, sensors.PM1, sensors.UnitMicrogramsPerCubicMeter, data.PM1)
+	sensors.AddOptional(r, sensors.PM25, sensors.UnitMicrogramsPerCubicMeter, data.PM25)
+	sensors.AddOptional(r, sensors.PM4, sensors.UnitMicrogramsPerCubicMeter, data.PM4)
+	sensors.AddOptional(r, sensors.PM10, sensors.UnitMicrogramsPerCubicMeter, data.PM10)
+	sensors.AddOptional(r, sensors.CO2, sensors.UnitPPM, data.CO2)
+	sensors.AddOptional(r, sensors.VOC, sensors.UnitNone, data.VOC)
+	sensors.AddOptional(r, sensors.NOx, sensors.UnitNone, data.NOx)
+	sensors.AddOptional(r, sensors.Illuminance, sensors.UnitLux, data.Luminosity)
+	rv.Record(r)
 
 	return nil
 }
@@ -0,0 +1,29 @@
+package sensors
+
+// schemaColumns are the columns of the tables of doc/schema.sql used by the drivers, besides
+// time and room.
+var schemaColumns = map[string][]string{
+	DefaultTable: {
+		"temperature", "humidity", "battery", "voltage",
+		"reed_switch", "trigger_output", "trigger_control", "temperature_trigger", "humidity_trigger",
+		"pressure", "txpower", "acceleration_x", "acceleration_y", "acceleration_z",
+		"movement_counter", "sequence", "co2", "co2_status",
+		"pm1_0", "pm2_5", "pm4_0", "pm10", "voc", "nox", "luminosity",
+	},
+	"home_bthome": {
+		"temperature", "humidity", "pressure", "illuminance", "battery", "voltage", "co2",
+		"motion", "window", "button",
+	},
+	"home_plants": {"temperature", "moisture", "conductivity", "lux", "battery"},
+}
+
+// HasColumn reports whether the table of doc/schema.sql used by the driver has a column to
+// store a measurement.
+func (d *Driver) HasColumn(column string) bool {
+	for _, c := range schemaColumns[d.SchemaTable()] {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package sensors
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The columns known to the drivers must match doc/schema.sql.
+func TestSchemaColumns(t *testing.T) {
+	schema, err := os.ReadFile("../../doc/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tableRe := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\n\);`)
+	columnRe := regexp.MustCompile(`(?m)^  (\w+) `)
+
+	tables := make(map[string][]string)
+	for _, m := range tableRe.FindAllStringSubmatch(string(schema), -1) {
+		var columns []string
+		for _, c := range columnRe.FindAllStringSubmatch(m[2], -1) {
+			if c[1] != "time" && c[1] != "room" {
+				columns = append(columns, c[1])
+			}
+		}
+		tables[m[1]] = columns
+	}
+
+	for table, want := range schemaColumns {
+		if got := tables[table]; !reflect.DeepEqual(got, want) {
+			t.Errorf("columns of %s in doc/schema.sql:\n%s\nwant:\n%s",
+				table, strings.Join(got, ", "), strings.Join(want, ", "))
+		}
+	}
+}
+
+func TestHasColumn(t *testing.T) {
+	d := Driver{Firmware: "test"}
+	if !d.HasColumn("co2_status") {
+		t.Errorf("co2_status is not a column of %s", d.SchemaTable())
+	}
+	if d.HasColumn("moisture") {
+		t.Errorf("moisture is a column of %s", d.SchemaTable())
+	}
+
+	d.Table = "home_plants"
+	if !d.HasColumn("moisture") {
+		t.Errorf("moisture is not a column of %s", d.SchemaTable())
+	}
+}
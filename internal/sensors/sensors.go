@@ -1,18 +1,20 @@
 package sensors
 
 import (
-	"context"
 	"time"
 
-	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/piger/sensor-probe/internal/config"
 	"github.com/piger/sensor-probe/internal/homekit"
 	"gitlab.com/jtaimisto/bluewalker/host"
 )
 
 const (
-	HomeKitUpdateInterval  = 2 * time.Minute
-	DatabaseUpdateInterval = 5 * time.Minute
+	// HomeKitUpdateInterval is the default interval between the HomeKit updates of a sensor.
+	HomeKitUpdateInterval = 2 * time.Minute
+
+	// DefaultStaleTimeout is how long the last reading of a sensor is considered current, unless
+	// the sensor sets a different timeout.
+	DefaultStaleTimeout = 30 * time.Minute
 )
 
 type Sensor struct {
@@ -23,6 +25,41 @@ type Sensor struct {
 	Accessory         *homekit.TemperatureHumiditySensor
 	LastUpdateHomeKit time.Time
 	LastUpdateDB      time.Time
+	LastReading       *Reading
+
+	// StoredReading is the last reading stored, which isn't stored again.
+	StoredReading *Reading
+
+	// Columns maps the quantities stored in a column with a different name.
+	Columns map[Quantity]string
+
+	// UpdateAccessory sends a reading to HomeKit; it defaults to UpdateTemperatureHumidity.
+	UpdateAccessory func(*Reading)
+
+	// OnReading, if set, is called with every new reading.
+	OnReading func(*Reading)
+
+	// StoreInterval is how often the readings are stored, and HomeKitInterval how often they're
+	// sent to HomeKit; HomeKitInterval defaults to HomeKitUpdateInterval.
+	StoreInterval   time.Duration
+	HomeKitInterval time.Duration
+
+	// Stats accumulates the readings received since the last storage round.
+	Stats Aggregate
+
+	// StaleTimeout is how long the last reading is considered current; it defaults to
+	// DefaultStaleTimeout. Stale is set when no reading was received for that long, and reset by
+	// the next reading; a sensor never heard is stale once StaleTimeout has passed since Started.
+	StaleTimeout time.Duration
+	Stale        bool
+	Started      time.Time
+
+	// OnStale, if set, is called when the sensor becomes stale, and when it sends readings again.
+	OnStale func(s *Sensor, stale bool)
+
+	// OnInvalid, if set, is called with the name of every measurement that the sensor reported as
+	// not available.
+	OnInvalid func(s *Sensor, name string)
 }
 
 func NewSensor(config *config.SensorConfig, acc *homekit.TemperatureHumiditySensor) *Sensor {
@@ -33,9 +70,83 @@ func NewSensor(config *config.SensorConfig, acc *homekit.TemperatureHumiditySens
 		Firmware:  config.Firmware,
 		Accessory: acc,
 	}
+	s.UpdateAccessory = s.UpdateTemperatureHumidity
 	return &s
 }
 
+// Record stores the latest reading of the sensor and sends it to HomeKit, at most once every
+// HomeKitInterval.
+func (s *Sensor) Record(r *Reading) {
+	s.RecordMerged(r, r)
+}
+
+// RecordMerged is Record for the drivers whose readings merge the values received in several
+// advertisements: only the values of sample, decoded from the last advertisement, are added to the
+// statistics, so that the older values aren't counted again.
+func (s *Sensor) RecordMerged(r, sample *Reading) {
+	s.LastReading = r
+	s.Stats.Add(sample)
+	if s.Stale {
+		s.setStale(false)
+	}
+	if s.OnReading != nil {
+		s.OnReading(r)
+	}
+
+	interval := s.HomeKitInterval
+	if interval == 0 {
+		interval = HomeKitUpdateInterval
+	}
+	if s.LastUpdateHomeKit.IsZero() || r.Time.Sub(s.LastUpdateHomeKit) >= interval {
+		s.UpdateAccessory(r)
+		s.LastUpdateHomeKit = r.Time
+	}
+}
+
+// CheckStale marks the sensor as stale when its last reading, or the start of the probe if no
+// reading was received, is older than StaleTimeout, and tells whether the sensor is stale.
+func (s *Sensor) CheckStale(now time.Time) bool {
+	if s.Stale {
+		return true
+	}
+
+	last := s.Started
+	if s.LastReading != nil {
+		last = s.LastReading.Time
+	}
+	if last.IsZero() {
+		return false
+	}
+
+	timeout := s.StaleTimeout
+	if timeout == 0 {
+		timeout = DefaultStaleTimeout
+	}
+	if now.Sub(last) > timeout {
+		s.setStale(true)
+	}
+	return s.Stale
+}
+
+// setStale marks the sensor as stale, or as working again, in HomeKit.
+func (s *Sensor) setStale(stale bool) {
+	s.Stale = stale
+	s.Accessory.SetActive(!stale)
+	if s.OnStale != nil {
+		s.OnStale(s, stale)
+	}
+}
+
+// UpdateTemperatureHumidity sets the temperature and the humidity of the HomeKit accessory.
+func (s *Sensor) UpdateTemperatureHumidity(r *Reading) {
+	if m, ok := r.Get(Temperature); ok {
+		s.SetTemperature(m.Value)
+	}
+	if m, ok := r.Get(Humidity); ok {
+		s.SetHumidity(m.Value)
+	}
+}
+
 func (s *Sensor) SetTemperature(v float64) {
 	s.Accessory.TemperatureSensor.CurrentTemperature.SetValue(v)
 }
@@ -44,10 +155,38 @@ func (s *Sensor) SetHumidity(v float64) {
 	s.Accessory.HumiditySensor.CurrentRelativeHumidity.SetValue(v)
 }
 
+// CountInvalid records that the sensor reported the named measurement as not available.
+func (s *Sensor) CountInvalid(name string) {
+	if s.OnInvalid != nil {
+		s.OnInvalid(s, name)
+	}
+}
+
 func (s *Sensor) GetAccessory() *homekit.TemperatureHumiditySensor {
 	return s.Accessory
 }
 
+func (s *Sensor) GetName() string {
+	return s.Name
+}
+
+func (s *Sensor) GetLastReading() *Reading {
+	return s.LastReading
+}
+
+// GetSensor returns the state shared by all the sensors.
+func (s *Sensor) GetSensor() *Sensor {
+	return s
+}
+
+// Column returns the name of the database column storing a quantity.
+func (s *Sensor) Column(q Quantity) string {
+	if column, ok := s.Columns[q]; ok {
+		return column
+	}
+	return string(q)
+}
+
 type SensorUpdater interface {
 	// GetName returns the name of a Sensor; it's used to name the sensor in error messages.
 	GetName() string
@@ -55,8 +194,11 @@ type SensorUpdater interface {
 	// Update search for sensor data in a bluetooth broadcast, set them in HomeKit and store the data.
 	Update(*host.ScanReport) error
 
-	// Push push the latest set of sensor data to the metrics server.
-	Push(context.Context, *pgxpool.Pool, time.Time) error
+	// GetLastReading returns the latest reading, or nil if the sensor wasn't heard yet.
+	GetLastReading() *Reading
+
+	// GetSensor returns the state shared by all the sensors.
+	GetSensor() *Sensor
 
 	// GetAccessory returns the embedded HomeKit accessory.
 	GetAccessory() *homekit.TemperatureHumiditySensor
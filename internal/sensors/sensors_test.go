@@ -0,0 +1,56 @@
+package sensors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+)
+
+func TestCheckStale(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		started time.Time
+		last    time.Time // the time of the last reading, if any
+		now     time.Time
+		stale   bool
+	}{
+		{"recent reading", start, start.Add(time.Hour), start.Add(time.Hour + 10*time.Minute), false},
+		{"old reading", start, start.Add(time.Hour), start.Add(time.Hour + 31*time.Minute), true},
+		{"never heard, just started", start, time.Time{}, start.Add(10 * time.Minute), false},
+		{"never heard since the start", start, time.Time{}, start.Add(31 * time.Minute), true},
+		{"not started", time.Time{}, time.Time{}, start.Add(time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		var events []bool
+		s := NewSensor(&config.SensorConfig{Name: "test"}, homekit.NewTemperatureHumiditySensor(accessory.Info{Name: "test"}))
+		s.Started = tt.started
+		s.OnStale = func(_ *Sensor, stale bool) { events = append(events, stale) }
+		if !tt.last.IsZero() {
+			s.LastReading = &Reading{Time: tt.last}
+		}
+
+		if got := s.CheckStale(tt.now); got != tt.stale {
+			t.Errorf("%s: CheckStale = %v, want %v", tt.name, got, tt.stale)
+		}
+		if tt.stale && (len(events) != 1 || !events[0]) {
+			t.Errorf("%s: OnStale events %v, want [true]", tt.name, events)
+		}
+
+		// once stale, the sensor stays silent until the next reading.
+		if tt.stale {
+			if !s.CheckStale(tt.now.Add(time.Minute)) || len(events) != 1 {
+				t.Errorf("%s: the sensor was marked stale twice", tt.name)
+			}
+			s.Record(&Reading{Time: tt.now})
+			if s.Stale || s.CheckStale(tt.now.Add(time.Minute)) || len(events) != 2 || events[1] {
+				t.Errorf("%s: the sensor is still stale after a reading (events %v)", tt.name, events)
+			}
+		}
+	}
+}
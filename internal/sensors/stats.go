@@ -0,0 +1,66 @@
+package sensors
+
+// Stats summarizes the values of a quantity received during a storage interval.
+type Stats struct {
+	Quantity Quantity
+	Unit     Unit
+	Min      float64
+	Max      float64
+	Mean     float64
+	Last     float64
+	Count    int
+
+	sum float64
+}
+
+// Aggregate accumulates the values of the numeric quantities received by a sensor between two
+// storage rounds; the boolean quantities are skipped.
+type Aggregate struct {
+	stats []*Stats
+	index map[Quantity]int
+}
+
+// Add adds the measurements of a reading to the statistics.
+func (a *Aggregate) Add(r *Reading) {
+	if a.index == nil {
+		a.index = make(map[Quantity]int)
+	}
+
+	for _, m := range r.Measurements {
+		if m.Unit == UnitBoolean {
+			continue
+		}
+
+		i, ok := a.index[m.Quantity]
+		if !ok {
+			i = len(a.stats)
+			a.index[m.Quantity] = i
+			a.stats = append(a.stats, &Stats{Quantity: m.Quantity, Unit: m.Unit, Min: m.Value, Max: m.Value})
+		}
+
+		st := a.stats[i]
+		if m.Value < st.Min {
+			st.Min = m.Value
+		}
+		if m.Value > st.Max {
+			st.Max = m.Value
+		}
+		st.Last = m.Value
+		st.sum += m.Value
+		st.Count++
+	}
+}
+
+// Take returns the statistics of each quantity, in the order they were first received, and
+// starts a new interval.
+func (a *Aggregate) Take() []Stats {
+	result := make([]Stats, len(a.stats))
+	for i, st := range a.stats {
+		result[i] = *st
+		result[i].Mean = st.sum / float64(st.Count)
+	}
+
+	a.stats = nil
+	a.index = nil
+	return result
+}
@@ -0,0 +1,67 @@
+package sensors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func reading(values ...float64) *Reading {
+	r := &Reading{Time: time.Now()}
+	for _, v := range values {
+		r.Add(Temperature, UnitCelsius, v)
+	}
+	return r
+}
+
+func TestAggregate(t *testing.T) {
+	var a Aggregate
+	if stats := a.Take(); len(stats) != 0 {
+		t.Errorf("Take of an empty interval = %+v", stats)
+	}
+
+	r := reading(21)
+	r.AddBool(ReedSwitch, true)
+	r.Add(Humidity, UnitPercent, 40)
+	a.Add(r)
+	a.Add(reading(19))
+	a.Add(reading(23, 22))
+
+	want := []Stats{
+		{Quantity: Temperature, Unit: UnitCelsius, Min: 19, Max: 23, Mean: 21.25, Last: 22, Count: 4, sum: 85},
+		{Quantity: Humidity, Unit: UnitPercent, Min: 40, Max: 40, Mean: 40, Last: 40, Count: 1, sum: 40},
+	}
+	if got := a.Take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Take = %+v, want %+v", got, want)
+	}
+
+	// Take starts a new interval.
+	a.Add(reading(-5))
+	want = []Stats{{Quantity: Temperature, Unit: UnitCelsius, Min: -5, Max: -5, Mean: -5, Last: -5, Count: 1, sum: -5}}
+	if got := a.Take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Take after a new reading = %+v, want %+v", got, want)
+	}
+	if stats := a.Take(); len(stats) != 0 {
+		t.Errorf("Take of an empty interval = %+v", stats)
+	}
+}
+
+func TestRecordMerged(t *testing.T) {
+	s := &Sensor{Name: "test", UpdateAccessory: func(*Reading) {}}
+
+	full := reading(21)
+	full.Add(Humidity, UnitPercent, 40)
+	s.Record(full)
+
+	merged := reading(22)
+	merged.Add(Humidity, UnitPercent, 40)
+	s.RecordMerged(merged, reading(22))
+
+	if s.LastReading != merged {
+		t.Error("the merged reading is not the last reading")
+	}
+	stats := s.Stats.Take()
+	if len(stats) != 2 || stats[0].Count != 2 || stats[0].Last != 22 || stats[1].Count != 1 {
+		t.Errorf("Take = %+v, want 2 temperatures and 1 humidity", stats)
+	}
+}
@@ -0,0 +1,185 @@
+// SwitchBot Meter, Meter Plus and Outdoor Meter
+// https://github.com/OpenWonderLabs/SwitchBotAPI-BLE/blob/latest/devicetypes/meter.md
+
+package switchbot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Service UUID and manufacturer ID: Woan Technology (SwitchBot).
+const (
+	UUID           = 0xfd3d
+	ManufacturerID = 0x0969
+)
+
+// Firmware is the name of the SwitchBot driver in the configuration file.
+const Firmware = "switchbot"
+
+// Device types, stored in the first byte of the service data.
+const (
+	modelMeter        = 'T'
+	modelMeterPlus    = 'i'
+	modelOutdoorMeter = 'w'
+)
+
+func init() {
+	// SwitchBot devices use a random static Bluetooth address.
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LeRandomAddress,
+		Filter: filter.Any([]filter.AdFilter{
+			filter.ByAdData(hci.AdServiceData, []byte{0x3d, 0xfd}),
+			filter.ByVendor([]byte{0x69, 0x09}),
+		}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewSwitchBotSensor(config, id), nil
+		},
+	})
+}
+
+// errNoTemperature is returned, along with the battery level, for the advertisements that don't
+// carry any temperature data.
+var errNoTemperature = errors.New("SwitchBot advertisement without temperature data")
+
+type Data struct {
+	Temperature float32
+	Humidity    float32
+	Battery     *uint16 // only sent in the service data
+}
+
+// decodeTemperature decodes the 3 bytes holding the temperature and the humidity: the first byte
+// has the temperature decimal in its lower nibble, the second the temperature integer part with
+// the sign in the most significant bit (set when positive), and the third the humidity.
+func decodeTemperature(b []byte) (float32, float32) {
+	temperature := float32(b[1]&0x7f) + float32(b[0]&0x0f)/10
+	if b[1]&0x80 == 0 {
+		temperature = -temperature
+	}
+	humidity := float32(b[2] & 0x7f)
+
+	return temperature, humidity
+}
+
+// parseMessage decodes the service data and the manufacturer data of an advertisement; both
+// include their UUID and either can be nil. Older meters only send the measurements in the
+// service data, while the newer models send them in the manufacturer data.
+func parseMessage(svc, mfr []byte) (*Data, error) {
+	var data Data
+	var temperatureData []byte
+
+	if len(svc) >= 5 {
+		switch model := svc[2] & 0x7f; model {
+		case modelMeter, modelMeterPlus, modelOutdoorMeter:
+		default:
+			return nil, fmt.Errorf("unsupported SwitchBot device type: 0x%02x", model)
+		}
+
+		battery := uint16(svc[4] & 0x7f)
+		data.Battery = &battery
+
+		if len(svc) >= 8 {
+			temperatureData = svc[5:8]
+		}
+	}
+
+	// manufacturer ID, MAC address, sequence number and 2 more bytes.
+	if len(mfr) >= 13 {
+		temperatureData = mfr[10:13]
+	}
+
+	if temperatureData == nil {
+		return &data, errNoTemperature
+	}
+	data.Temperature, data.Humidity = decodeTemperature(temperatureData)
+
+	return &data, nil
+}
+
+func isServiceData(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdServiceData && len(r.Data) >= 2 && binary.LittleEndian.Uint16(r.Data) == UUID
+}
+
+func isManufacturerData(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdManufacturerSpecific && len(r.Data) >= 2 && binary.LittleEndian.Uint16(r.Data) == ManufacturerID
+}
+
+type SwitchBotSensor struct {
+	*sensors.Sensor
+
+	// the battery level is only sent in the service data, and it's added to the readings
+	// decoded from the manufacturer data.
+	battery *uint16
+}
+
+func NewSwitchBotSensor(config *config.SensorConfig, id uint64) *SwitchBotSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "SwitchBot Meter",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "SwitchBot",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	ss := SwitchBotSensor{
+		Sensor: s,
+	}
+	return &ss
+}
+
+func (s *SwitchBotSensor) Update(report *host.ScanReport) error {
+	var svc, mfr []byte
+	for _, ads := range report.Data {
+		switch {
+		case isServiceData(ads):
+			svc = ads.Data
+		case isManufacturerData(ads):
+			mfr = ads.Data
+		}
+	}
+
+	// the service data and the manufacturer data can arrive in separate reports (advertisement
+	// and scan response).
+	if svc == nil && mfr == nil {
+		return nil
+	}
+
+	if err := s.handleBroadcast(report, svc, mfr); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+func (s *SwitchBotSensor) handleBroadcast(report *host.ScanReport, svc, mfr []byte) error {
+	data, err := parseMessage(svc, mfr)
+	if data != nil && data.Battery != nil {
+		s.battery = data.Battery
+	}
+	if errors.Is(err, errNoTemperature) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	r := s.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	sensors.AddOptional(r, sensors.Battery, sensors.UnitPercent, s.battery)
+	s.Record(r)
+
+	return nil
+}
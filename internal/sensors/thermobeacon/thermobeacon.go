@@ -0,0 +1,148 @@
+// ThermoBeacon thermo-hygrometers (Brifit, ORIA, SensorBlue, ...)
+// https://github.com/Bluetooth-Devices/thermobeacon-ble
+
+package thermobeacon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/homekit"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"gitlab.com/jtaimisto/bluewalker/filter"
+	"gitlab.com/jtaimisto/bluewalker/hci"
+	"gitlab.com/jtaimisto/bluewalker/host"
+)
+
+// Firmware is the name of the ThermoBeacon driver in the configuration file.
+const Firmware = "thermobeacon"
+
+// localName is the name advertised by the sensors.
+const localName = "ThermoBeacon"
+
+// payloadSize is the size of the manufacturer data carrying the measurements; the manufacturer
+// ID changes between models, so the messages are recognised by their size. The sensors also
+// send 22 bytes messages with the minimum and maximum values, which are ignored.
+const payloadSize = 20
+
+func init() {
+	sensors.Register(&sensors.Driver{
+		Firmware:    Firmware,
+		AddressType: hci.LePublicAddress,
+		Filter: filter.Any([]filter.AdFilter{
+			sensors.ByLocalName(localName),
+			sensors.ByAdDataLength(hci.AdManufacturerSpecific, payloadSize),
+		}),
+		New: func(config *config.SensorConfig, id uint64) (sensors.SensorUpdater, error) {
+			return NewThermoBeaconSensor(config, id), nil
+		},
+	})
+}
+
+// all the fields are little endian.
+type payload struct {
+	ManufacturerID uint16
+	Flags          uint8
+	Button         uint8 // the MSB is set while the button is pressed
+	MAC            [6]uint8
+	Voltage        uint16 // mV
+	Temperature    int16  // 1/16 °C
+	Humidity       uint16 // 1/16 %
+	Uptime         uint32 // seconds
+}
+
+type Data struct {
+	Temperature float32
+	Humidity    float32
+	Voltage     int // mV
+	Battery     uint16
+}
+
+// batteryLevel estimates the battery level from its voltage, using the same curve as the
+// vendor app.
+func batteryLevel(mV int) uint16 {
+	switch {
+	case mV >= 3000:
+		return 100
+	case mV >= 2600:
+		return uint16(60 + (mV-2600)/10)
+	case mV >= 2500:
+		return uint16(40 + (mV-2500)/5)
+	case mV >= 2450:
+		return uint16(20 + (mV-2450)*2/5)
+	default:
+		return 0
+	}
+}
+
+func parseMessage(b []byte) (*Data, error) {
+	var p payload
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &p); err != nil {
+		return nil, err
+	}
+
+	data := Data{
+		Temperature: float32(p.Temperature) / 16,
+		Humidity:    float32(p.Humidity) / 16,
+		Voltage:     int(p.Voltage),
+		Battery:     batteryLevel(int(p.Voltage)),
+	}
+	return &data, nil
+}
+
+func checkReport(r *hci.AdStructure) bool {
+	return r.Typ == hci.AdManufacturerSpecific && len(r.Data) == payloadSize
+}
+
+type ThermoBeaconSensor struct {
+	*sensors.Sensor
+}
+
+func NewThermoBeaconSensor(config *config.SensorConfig, id uint64) *ThermoBeaconSensor {
+	info := accessory.Info{
+		Name:         config.Name,
+		Model:        "ThermoBeacon",
+		SerialNumber: "ABCDEFG",
+		Manufacturer: "ThermoBeacon",
+		ID:           id,
+	}
+
+	acc := homekit.NewTemperatureHumiditySensor(info)
+	s := sensors.NewSensor(config, acc)
+
+	ts := ThermoBeaconSensor{
+		Sensor: s,
+	}
+	return &ts
+}
+
+func (tb *ThermoBeaconSensor) Update(report *host.ScanReport) error {
+	for _, ads := range report.Data {
+		if checkReport(ads) {
+			if err := tb.handleBroadcast(report, ads); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (tb *ThermoBeaconSensor) handleBroadcast(report *host.ScanReport, msg *hci.AdStructure) error {
+	data, err := parseMessage(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	r := tb.NewReading(report)
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(data.Temperature))
+	r.Add(sensors.Humidity, sensors.UnitPercent, float64(data.Humidity))
+	r.Add(sensors.Battery, sensors.UnitPercent, float64(data.Battery))
+	r.Add(sensors.Voltage, sensors.UnitMillivolt, float64(data.Voltage))
+	tb.Record(r)
+
+	return nil
+}
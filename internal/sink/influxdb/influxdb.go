@@ -0,0 +1,285 @@
+// InfluxDB storage backend, using the line protocol over the HTTP API of InfluxDB 1.x and 2.x.
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+// Type is the name of the InfluxDB backend in the configuration file.
+const Type = "influxdb"
+
+const (
+	defaultMeasurement = "sensors"
+
+	// maxPoints is the number of points kept while InfluxDB can't be reached; the oldest ones are
+	// dropped first.
+	maxPoints = 10000
+
+	maxRetries   = 3
+	retryBackoff = time.Second
+	writeTimeout = 10 * time.Second
+
+	// flushTimeout bounds a whole flush, retries included, since the flushes block the probe.
+	flushTimeout = 20 * time.Second
+)
+
+func init() {
+	sink.Register(Type, func(ctx context.Context, config *config.SinkConfig) (sink.Sink, error) {
+		return Open(config)
+	})
+}
+
+// Sink buffers the readings, and writes them to InfluxDB as lines when flushed.
+type Sink struct {
+	client      *http.Client
+	writeURL    string
+	token       string
+	measurement string
+	tags        []string
+	staticTags  string // already escaped and sorted
+
+	points []sink.Point
+}
+
+// Open checks the configuration and builds the URL of the write endpoint.
+func Open(cfg *config.SinkConfig) (*Sink, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("the InfluxDB url is missing")
+	}
+
+	base := strings.TrimSuffix(cfg.URL, "/")
+	params := url.Values{}
+	var endpoint string
+
+	switch cfg.Version {
+	case 1:
+		if cfg.Database == "" {
+			return nil, errors.New("InfluxDB 1.x needs a database")
+		}
+		endpoint = "/write"
+		params.Set("db", cfg.Database)
+	case 0, 2:
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return nil, errors.New("InfluxDB 2.x needs an org and a bucket")
+		}
+		endpoint = "/api/v2/write"
+		params.Set("org", cfg.Org)
+		params.Set("bucket", cfg.Bucket)
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB version %d", cfg.Version)
+	}
+	params.Set("precision", "s")
+
+	s := Sink{
+		client:      &http.Client{Timeout: writeTimeout},
+		writeURL:    base + endpoint + "?" + params.Encode(),
+		token:       cfg.Token,
+		measurement: cfg.Measurement,
+		tags:        cfg.Tags,
+	}
+	if s.measurement == "" {
+		s.measurement = defaultMeasurement
+	}
+	if len(s.tags) == 0 {
+		s.tags = []string{"sensor", "mac", "firmware"}
+	}
+
+	keys := make([]string, 0, len(cfg.StaticTags))
+	for k := range cfg.StaticTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.staticTags += "," + escapeKey(k) + "=" + escapeKey(cfg.StaticTags[k])
+	}
+
+	return &s, nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// escapeKey escapes tag keys, tag values and field keys.
+func escapeKey(s string) string {
+	return keyEscaper.Replace(s)
+}
+
+// tagSet encodes the tags of a point.
+func (s *Sink) tagSet(p sink.Point) string {
+	var sb strings.Builder
+	for _, tag := range s.tags {
+		var v string
+		switch tag {
+		case "sensor":
+			v = p.Reading.Name
+		case "mac":
+			v = p.Reading.MAC
+		case "firmware":
+			v = p.Reading.Firmware
+		}
+		if v != "" {
+			sb.WriteString("," + tag + "=" + escapeKey(v))
+		}
+	}
+	sb.WriteString(s.staticTags)
+	return sb.String()
+}
+
+// lines encodes a point, followed by its statistics in the "<measurement>_stats" measurement, one
+// line for each quantity; the numeric measurements are always written as floats, so that the field
+// types don't change between the sensors, and the boolean ones as booleans.
+func (s *Sink) lines(p sink.Point) []string {
+	var sb strings.Builder
+	tags := s.tagSet(p)
+	ts := " " + strconv.FormatInt(p.Time.Unix(), 10)
+
+	sb.WriteString(measurementEscaper.Replace(s.measurement) + tags)
+	sb.WriteString(" rssi=" + strconv.FormatFloat(float64(p.Reading.RSSI), 'f', -1, 64))
+	for _, m := range p.Reading.Measurements {
+		sb.WriteString("," + escapeKey(string(m.Quantity)) + "=")
+		if m.Unit == sensors.UnitBoolean {
+			sb.WriteString(strconv.FormatBool(m.Bool()))
+		} else {
+			sb.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+		}
+	}
+
+	sb.WriteString(ts)
+	lines := []string{sb.String()}
+
+	for _, st := range p.Stats {
+		lines = append(lines, measurementEscaper.Replace(s.measurement+"_stats")+tags+
+			",quantity="+escapeKey(string(st.Quantity))+
+			" min="+strconv.FormatFloat(st.Min, 'f', -1, 64)+
+			",max="+strconv.FormatFloat(st.Max, 'f', -1, 64)+
+			",mean="+strconv.FormatFloat(st.Mean, 'f', -1, 64)+
+			",last="+strconv.FormatFloat(st.Last, 'f', -1, 64)+
+			",samples="+strconv.Itoa(st.Count)+"i"+ts)
+	}
+	return lines
+}
+
+// Write adds a reading to the next batch.
+func (s *Sink) Write(ctx context.Context, p sink.Point) error {
+	s.points = append(s.points, p)
+	if len(s.points) > maxPoints {
+		log.Printf("InfluxDB: dropping %d points", len(s.points)-maxPoints)
+		s.points = s.points[len(s.points)-maxPoints:]
+	}
+	return nil
+}
+
+// permanentError is returned for the requests rejected by InfluxDB, which are not retried.
+type permanentError struct {
+	error
+}
+
+func (s *Sink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Flush writes the batch, retrying with an exponential backoff for at most flushTimeout; the
+// batch is kept for the next flush if InfluxDB can't be reached, and dropped if InfluxDB rejects
+// it.
+func (s *Sink) Flush(ctx context.Context) error {
+	if len(s.points) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, flushTimeout)
+	defer cancel()
+
+	var lines []string
+	for _, p := range s.points {
+		lines = append(lines, s.lines(p)...)
+	}
+	body := []byte(strings.Join(lines, "\n"))
+
+	backoff := retryBackoff
+	var err error
+retry:
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				break retry
+			}
+			backoff *= 2
+		}
+
+		err = s.post(ctx, body)
+		if err == nil {
+			s.points = s.points[:0]
+			return nil
+		}
+
+		var perr permanentError
+		if errors.As(err, &perr) {
+			log.Printf("InfluxDB rejected the batch: dropping %d points from %s",
+				len(s.points), strings.Join(sink.SensorNames(s.points), ", "))
+			s.points = s.points[:0]
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w (keeping %d points for the next attempt)", err, len(s.points))
+}
+
+// Unflushed returns the points kept after a failed flush, and forgets them.
+func (s *Sink) Unflushed() []sink.Point {
+	points := s.points
+	s.points = nil
+	return points
+}
+
+// Close tries to write the last batch.
+func (s *Sink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	return s.Flush(ctx)
+}
@@ -0,0 +1,145 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+func testPoint(name string, t time.Time) sink.Point {
+	r := &sensors.Reading{Time: t, Name: name, MAC: "a4:c1:38:01:01:01", Firmware: "pvvx", RSSI: -70}
+	r.Add(sensors.Temperature, sensors.UnitCelsius, 21.5)
+	r.AddBool(sensors.ReedSwitch, true)
+	return sink.Point{Time: t, Sensor: &sensors.Sensor{Name: name}, Reading: r}
+}
+
+func openTest(t *testing.T, handler http.HandlerFunc) *Sink {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	s, err := Open(&config.SinkConfig{
+		Type: Type, URL: server.URL, Org: "home", Bucket: "sensors", Token: "secret",
+		StaticTags: map[string]string{"site": "the cottage"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFlush(t *testing.T) {
+	var body, auth, query string
+	s := openTest(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, auth, query = string(b), r.Header.Get("Authorization"), r.URL.RawQuery
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ts := time.Unix(1700000000, 0)
+	for _, name := range []string{"bedroom", "living room"} {
+		p := testPoint(name, ts)
+		if name == "bedroom" {
+			p.Stats = []sensors.Stats{{Quantity: sensors.Temperature, Min: 20, Max: 22.5, Mean: 21.25, Last: 21.5, Count: 4}}
+		}
+		if err := s.Write(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	want := `sensors,sensor=bedroom,mac=a4:c1:38:01:01:01,firmware=pvvx,site=the\ cottage rssi=-70,temperature=21.5,reed_switch=true 1700000000
+sensors_stats,sensor=bedroom,mac=a4:c1:38:01:01:01,firmware=pvvx,site=the\ cottage,quantity=temperature min=20,max=22.5,mean=21.25,last=21.5,samples=4i 1700000000
+sensors,sensor=living\ room,mac=a4:c1:38:01:01:01,firmware=pvvx,site=the\ cottage rssi=-70,temperature=21.5,reed_switch=true 1700000000`
+	if body != want {
+		t.Errorf("body:\n%s\nwant:\n%s", body, want)
+	}
+	if auth != "Token secret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if query != "bucket=sensors&org=home&precision=s" {
+		t.Errorf("query = %q", query)
+	}
+	if len(s.points) != 0 {
+		t.Errorf("%d points left after a flush", len(s.points))
+	}
+}
+
+func TestFlushUnavailable(t *testing.T) {
+	var requests int32
+	s := openTest(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+
+	if err := s.Write(context.Background(), testPoint("bedroom", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deadline of the flush stops the retries.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.Flush(ctx)
+	if err == nil || !strings.Contains(err.Error(), "keeping 1 points") {
+		t.Fatalf("Flush: got error %v, want the points to be kept", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush took %s, past its deadline", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+
+	points := s.Unflushed()
+	if len(points) != 1 || points[0].Sensor.Name != "bedroom" {
+		t.Errorf("Unflushed = %+v, want the point of bedroom", points)
+	}
+	if len(s.Unflushed()) != 0 {
+		t.Error("the points were not forgotten by Unflushed")
+	}
+}
+
+func TestFlushRejected(t *testing.T) {
+	var requests int32
+	s := openTest(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unable to parse", http.StatusBadRequest)
+	})
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, name := range []string{"bedroom", "kitchen", "bedroom"} {
+		if err := s.Write(context.Background(), testPoint(name, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(context.Background()); err == nil {
+		t.Fatal("Flush succeeded, want an error")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d requests, want 1: a rejected batch is not retried", n)
+	}
+	if len(s.Unflushed()) != 0 {
+		t.Error("a rejected batch was kept")
+	}
+	if !strings.Contains(logs.String(), "dropping 3 points from bedroom, kitchen") {
+		t.Errorf("the dropped points were not logged: %q", logs.String())
+	}
+}
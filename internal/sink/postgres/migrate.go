@@ -0,0 +1,238 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/piger/sensor-probe/internal/config"
+)
+
+// migrationsFS contains the schema of doc/schema.sql as a list of migrations, named
+// <version>_<description>.sql; a column added to a table needs a new migration.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationsLockID is the key of the advisory lock taken while migrating, so that the probes
+// sharing a database don't apply the same migration twice.
+const migrationsLockID = 0x73656e73
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, file := range files {
+		prefix, _, ok := strings.Cut(file.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration name %q", file.Name())
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration name %q", file.Name())
+		}
+
+		data, err := migrationsFS.ReadFile(path.Join("migrations", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: file.Name(), sql: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// Migrate creates the tables used by the drivers, and applies the migrations not applied yet;
+// each migration runs in its own transaction, and the applied ones are recorded in the
+// sensor_probe_migrations table. Then it creates the tables of the sensors that are missing, with
+// the columns of their table in doc/schema.sql, and adds to the existing ones the columns added to
+// their table by the migrations.
+func (s *Sink) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("loading migrations: %w", err)
+	}
+
+	if _, err := s.pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS sensor_probe_migrations (
+  version integer PRIMARY KEY,
+  name text NOT NULL,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)`); err != nil {
+		return fmt.Errorf("creating the migrations table: %w", err)
+	}
+
+	for _, m := range migrations {
+		if err := s.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+			return applyMigration(ctx, tx, m)
+		}); err != nil {
+			return fmt.Errorf("applying migration %s: %w", m.name, err)
+		}
+	}
+
+	for _, table := range s.sensorTables() {
+		if err := s.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+			if err := createTable(ctx, tx, table); err != nil {
+				return err
+			}
+			return addColumns(ctx, tx, table)
+		}); err != nil {
+			return fmt.Errorf("creating table %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// statsSchema is the table of doc/schema.sql with the columns of the statistics table.
+const statsSchema = "sensor_stats"
+
+// createTable creates a table with the columns, defaults and indexes of its table in
+// doc/schema.sql, as a hypertable if the TimescaleDB extension is installed.
+func createTable(ctx context.Context, tx pgx.Tx, table config.Table) error {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockID); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table.Name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	name := pgx.Identifier(strings.Split(table.Name, ".")).Sanitize()
+	log.Printf("creating table %s like %s", table.Name, table.Schema)
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)",
+		name, pgx.Identifier{table.Schema}.Sanitize())); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(ctx, `DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+    PERFORM create_hypertable('`+name+`', 'time', if_not_exists => TRUE);
+  END IF;
+END
+$$`)
+	return err
+}
+
+// column is a column of a table, with its SQL type.
+type column struct {
+	name string
+	typ  string
+}
+
+// tableColumns returns the columns of a table, in order.
+func tableColumns(ctx context.Context, tx pgx.Tx, table string) ([]column, error) {
+	rows, err := tx.Query(ctx, `SELECT attname, format_type(atttypid, atttypmod)
+FROM pg_attribute
+WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped
+ORDER BY attnum`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []column
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.name, &c.typ); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// missingColumns returns the columns of template that table doesn't have.
+func missingColumns(template, table []column) []column {
+	existing := make(map[string]bool)
+	for _, c := range table {
+		existing[c.name] = true
+	}
+
+	var missing []column
+	for _, c := range template {
+		if !existing[c.name] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// addColumnsSQL returns the statement adding the columns to a table.
+func addColumnsSQL(table string, columns []column) string {
+	clauses := make([]string, len(columns))
+	for i, c := range columns {
+		clauses[i] = fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s NULL", pgx.Identifier{c.name}.Sanitize(), c.typ)
+	}
+	return fmt.Sprintf("ALTER TABLE %s %s", pgx.Identifier(strings.Split(table, ".")).Sanitize(), strings.Join(clauses, ", "))
+}
+
+// addColumns adds to a table the columns of its table in doc/schema.sql that it's missing: the
+// migrations only add the new columns to the tables of doc/schema.sql, not to the tables created
+// like them.
+func addColumns(ctx context.Context, tx pgx.Tx, table config.Table) error {
+	template, err := tableColumns(ctx, tx, table.Schema)
+	if err != nil {
+		return err
+	}
+	columns, err := tableColumns(ctx, tx, table.Name)
+	if err != nil {
+		return err
+	}
+
+	missing := missingColumns(template, columns)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(missing))
+	for i, c := range missing {
+		names[i] = c.name
+	}
+	log.Printf("adding the columns %s of %s to %s", strings.Join(names, ", "), table.Schema, table.Name)
+	_, err = tx.Exec(ctx, addColumnsSQL(table.Name, missing))
+	return err
+}
+
+func applyMigration(ctx context.Context, tx pgx.Tx, m migration) error {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockID); err != nil {
+		return err
+	}
+
+	var applied bool
+	if err := tx.QueryRow(ctx,
+		"SELECT EXISTS (SELECT 1 FROM sensor_probe_migrations WHERE version = $1)", m.version,
+	).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	log.Printf("applying database migration %s", m.name)
+	if _, err := tx.Exec(ctx, m.sql); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO sensor_probe_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+	return err
+}
@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/piger/sensor-probe/internal/config"
+)
+
+// A sensor table created like home_temperature before the migration adding trigger_control, and
+// the columns home_temperature has after it.
+func TestMissingColumns(t *testing.T) {
+	template := []column{
+		{"time", "timestamp without time zone"},
+		{"room", "text"},
+		{"temperature", "double precision"},
+		{"trigger_output", "boolean"},
+		{"co2_status", "smallint"},
+		{"trigger_control", "boolean"},
+	}
+	before := template[:4]
+
+	missing := missingColumns(template, before)
+	want := []column{{"co2_status", "smallint"}, {"trigger_control", "boolean"}}
+	if !reflect.DeepEqual(missing, want) {
+		t.Fatalf("got missing columns %+v, want %+v", missing, want)
+	}
+
+	got := addColumnsSQL("public.bedroom", missing)
+	wantSQL := `ALTER TABLE "public"."bedroom" ADD COLUMN IF NOT EXISTS "co2_status" smallint NULL, ` +
+		`ADD COLUMN IF NOT EXISTS "trigger_control" boolean NULL`
+	if got != wantSQL {
+		t.Errorf("got:\n%s\nwant:\n%s", got, wantSQL)
+	}
+
+	if missing := missingColumns(template, template); len(missing) != 0 {
+		t.Errorf("got missing columns %+v for an up to date table", missing)
+	}
+}
+
+// TestMigrateAddColumns needs a throwaway database, set in SENSOR_PROBE_TEST_DSN; the column
+// added by a migration is dropped from a sensor table, as if the table was created before it.
+func TestMigrateAddColumns(t *testing.T) {
+	dsn := os.Getenv("SENSOR_PROBE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("SENSOR_PROBE_TEST_DSN is not set")
+	}
+
+	ctx := context.Background()
+	s, err := Open(ctx, dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.pool.Close()
+	s.tables = []config.Table{{Name: "test_migrate_bedroom", Schema: "home_temperature"}}
+
+	if _, err := s.pool.Exec(ctx, "DROP TABLE IF EXISTS test_migrate_bedroom"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	if _, err := s.pool.Exec(ctx, "ALTER TABLE test_migrate_bedroom DROP COLUMN trigger_control"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	if err := s.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		template, err := tableColumns(ctx, tx, "home_temperature")
+		if err != nil {
+			return err
+		}
+		columns, err := tableColumns(ctx, tx, "test_migrate_bedroom")
+		if err != nil {
+			return err
+		}
+		if missing := missingColumns(template, columns); len(missing) != 0 {
+			t.Errorf("columns %+v are still missing", missing)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS home_temperature (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  temperature double PRECISION NULL,
+  humidity double PRECISION NULL,
+  battery double PRECISION NULL
+);
+
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+    PERFORM create_hypertable('home_temperature', 'time', if_not_exists => TRUE);
+  END IF;
+END
+$$;
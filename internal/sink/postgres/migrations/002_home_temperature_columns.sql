@@ -0,0 +1,23 @@
+-- the columns added by the pvvx, Ruuvi and Aranet4 drivers.
+ALTER TABLE home_temperature
+  ADD COLUMN IF NOT EXISTS voltage double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS reed_switch boolean NULL,
+  ADD COLUMN IF NOT EXISTS trigger_output boolean NULL,
+  ADD COLUMN IF NOT EXISTS temperature_trigger boolean NULL,
+  ADD COLUMN IF NOT EXISTS humidity_trigger boolean NULL,
+  ADD COLUMN IF NOT EXISTS pressure integer NULL,
+  ADD COLUMN IF NOT EXISTS txpower integer NULL,
+  ADD COLUMN IF NOT EXISTS acceleration_x double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS acceleration_y double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS acceleration_z double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS movement_counter integer NULL,
+  ADD COLUMN IF NOT EXISTS sequence integer NULL,
+  ADD COLUMN IF NOT EXISTS co2 integer NULL,
+  ADD COLUMN IF NOT EXISTS co2_status smallint NULL,
+  ADD COLUMN IF NOT EXISTS pm1_0 double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS pm2_5 double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS pm4_0 double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS pm10 double PRECISION NULL,
+  ADD COLUMN IF NOT EXISTS voc integer NULL,
+  ADD COLUMN IF NOT EXISTS nox integer NULL,
+  ADD COLUMN IF NOT EXISTS luminosity double PRECISION NULL;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS home_bthome (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  temperature double PRECISION NULL,
+  humidity double PRECISION NULL,
+  pressure double PRECISION NULL,
+  illuminance double PRECISION NULL,
+  battery double PRECISION NULL,
+  voltage double PRECISION NULL,
+  co2 integer NULL,
+  motion boolean NULL,
+  window boolean NULL,
+  button smallint NULL
+);
+
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+    PERFORM create_hypertable('home_bthome', 'time', if_not_exists => TRUE);
+  END IF;
+END
+$$;
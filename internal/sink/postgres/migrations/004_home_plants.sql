@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS home_plants (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  temperature double PRECISION NULL,
+  moisture smallint NULL,
+  conductivity integer NULL,
+  lux integer NULL,
+  battery double PRECISION NULL
+);
+
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+    PERFORM create_hypertable('home_plants', 'time', if_not_exists => TRUE);
+  END IF;
+END
+$$;
@@ -0,0 +1,20 @@
+-- the statistics of each quantity over a storage interval, written when "stats_table" is set;
+-- quantity is the name of the column storing the quantity in the table of the sensor.
+CREATE TABLE IF NOT EXISTS sensor_stats (
+  time TIMESTAMP NOT NULL,
+  room text NOT NULL,
+  quantity text NOT NULL,
+  min double PRECISION NOT NULL,
+  max double PRECISION NOT NULL,
+  mean double PRECISION NOT NULL,
+  last double PRECISION NOT NULL,
+  samples integer NOT NULL
+);
+
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+    PERFORM create_hypertable('sensor_stats', 'time', if_not_exists => TRUE);
+  END IF;
+END
+$$;
@@ -0,0 +1,3 @@
+-- the state of the trigger control flag sent by the pvvx firmware.
+ALTER TABLE home_temperature
+  ADD COLUMN IF NOT EXISTS trigger_control boolean NULL;
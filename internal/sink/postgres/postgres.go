@@ -0,0 +1,397 @@
+// PostgreSQL (TimescaleDB) storage backend.
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/db"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+	"golang.org/x/net/proxy"
+)
+
+// Type is the name of the PostgreSQL backend in the configuration file.
+const Type = "postgres"
+
+const (
+	// defaultBatchSize is the number of buffered points that triggers a flush before the end of
+	// the storage round.
+	defaultBatchSize = 1000
+
+	// maxPoints is the number of points kept while the database can't be reached; the oldest ones
+	// are dropped first.
+	maxPoints = 10000
+)
+
+func init() {
+	sink.Register(Type, func(ctx context.Context, config *config.SinkConfig) (sink.Sink, error) {
+		s, err := Open(ctx, config.DSN, config.SpoolDir != "")
+		if err != nil {
+			return nil, err
+		}
+		if config.BatchSize > 0 {
+			s.batchSize = config.BatchSize
+		}
+		s.statsTable = config.StatsTable
+		s.tables = config.Tables
+		s.migrate = config.Migrate
+
+		// without a connection the tables are prepared before the first write.
+		if config.SpoolDir == "" {
+			if err := s.prepare(ctx); err != nil {
+				s.pool.Close()
+				return nil, err
+			}
+		}
+		return s, nil
+	})
+}
+
+// Sink buffers the readings and writes them in a single transaction when flushed, with a COPY for
+// each table; each reading is written to the table configured in the sensor's "dbtable" setting,
+// and the sensors without a table are skipped.
+type Sink struct {
+	pool       *pgxpool.Pool
+	batchSize  int
+	statsTable string         // the table of the interval statistics, if any
+	tables     []config.Table // the tables of the sensors
+	migrate    bool           // the migrations are applied, and the missing tables created
+	prepared   bool           // the tables were created or checked
+
+	points []sink.Point
+}
+
+// Open connects to the database; the connection goes through the SOCKS5 proxy set in the
+// SOCKS_PROXY environment variable, if any. With lazy set the connection is only established by
+// the first write, so that the probe can start while the database is unreachable.
+func Open(ctx context.Context, dsn string, lazy bool) (*Sink, error) {
+	pgConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	socksProxy := os.Getenv("SOCKS_PROXY")
+	if socksProxy != "" {
+		dialer, err := proxy.SOCKS5("tcp", socksProxy, nil, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+
+		if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+			pgConfig.ConnConfig.DialFunc = contextDialer.DialContext
+		} else {
+			return nil, errors.New("failed type assertion into ContextDialer")
+		}
+
+		log.Printf("Using SOCKS5 proxy at %s", socksProxy)
+	}
+
+	pgConfig.LazyConnect = lazy
+
+	pool, err := pgxpool.ConnectConfig(ctx, pgConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{pool: pool, batchSize: defaultBatchSize}, nil
+}
+
+// Write adds a reading to the next batch, flushing the batch when it's full.
+func (s *Sink) Write(ctx context.Context, p sink.Point) error {
+	if p.Sensor.DBTable == "" {
+		return nil
+	}
+
+	s.points = append(s.points, p)
+	if len(s.points) > maxPoints {
+		log.Printf("PostgreSQL: dropping %d points", len(s.points)-maxPoints)
+		s.points = s.points[len(s.points)-maxPoints:]
+	}
+
+	if len(s.points) >= s.batchSize {
+		// the points are kept if the flush fails, and retried by the next one.
+		if err := s.Flush(ctx); err != nil {
+			log.Printf("error flushing a full batch: %s", err)
+		}
+	}
+	return nil
+}
+
+// BatchSize returns the number of buffered points that makes Write flush the batch.
+func (s *Sink) BatchSize() int {
+	return s.batchSize
+}
+
+// batch contains the rows to be copied into a table.
+type batch struct {
+	table   string
+	columns []string
+	rows    [][]interface{}
+	sensors []string
+}
+
+// statsColumns are the columns of the statistics table; "quantity" is the name of the column where
+// the quantity is stored in the table of the sensor.
+var statsColumns = []string{"time", "room", "quantity", "min", "max", "mean", "last", "samples"}
+
+// makeBatches groups the points by table; the columns of a table are the ones measured by any of
+// its sensors, and the quantities that weren't measured are left NULL. The statistics are written
+// to statsTable, if set.
+func makeBatches(points []sink.Point, statsTable string) []*batch {
+	var batches []*batch
+	byTable := make(map[string]*batch)
+	// the index of each column, by table.
+	indexes := make(map[string]map[string]int)
+
+	for _, p := range points {
+		b, ok := byTable[p.Sensor.DBTable]
+		if !ok {
+			b = &batch{table: p.Sensor.DBTable, columns: []string{"time", "room"}}
+			byTable[b.table] = b
+			indexes[b.table] = map[string]int{"time": 0, "room": 1}
+			batches = append(batches, b)
+		}
+		index := indexes[b.table]
+
+		row := make([]interface{}, len(b.columns), len(b.columns)+len(p.Reading.Measurements))
+		row[0], row[1] = p.Time, p.Sensor.Name
+		for _, m := range p.Reading.Measurements {
+			column := p.Sensor.Column(m.Quantity)
+			i, ok := index[column]
+			if !ok {
+				i = len(b.columns)
+				index[column] = i
+				b.columns = append(b.columns, column)
+			}
+			for len(row) <= i {
+				row = append(row, nil)
+			}
+
+			if m.Unit == sensors.UnitBoolean {
+				row[i] = m.Bool()
+			} else {
+				row[i] = m.Value
+			}
+		}
+
+		b.rows = append(b.rows, row)
+		b.sensors = append(b.sensors, p.Sensor.Name)
+	}
+
+	if statsTable != "" {
+		stats := batch{table: statsTable, columns: statsColumns}
+		for _, p := range points {
+			for _, st := range p.Stats {
+				stats.rows = append(stats.rows, []interface{}{
+					p.Time, p.Sensor.Name, p.Sensor.Column(st.Quantity),
+					st.Min, st.Max, st.Mean, st.Last, st.Count,
+				})
+				stats.sensors = append(stats.sensors, p.Sensor.Name)
+			}
+		}
+		if len(stats.rows) > 0 {
+			batches = append(batches, &stats)
+		}
+	}
+
+	// pad the rows added before the table got its last columns.
+	for _, b := range batches {
+		for i, row := range b.rows {
+			for len(row) < len(b.columns) {
+				row = append(row, nil)
+			}
+			b.rows[i] = row
+		}
+	}
+
+	return batches
+}
+
+// bySensor splits a batch in a batch for each sensor, with only the columns that have a value in
+// the rows of the sensor, so that its rows can't be rejected because of a column of another sensor.
+func (b *batch) bySensor() []*batch {
+	var batches []*batch
+	bySensor := make(map[string]*batch)
+	for i, row := range b.rows {
+		sb, ok := bySensor[b.sensors[i]]
+		if !ok {
+			sb = &batch{table: b.table}
+			bySensor[b.sensors[i]] = sb
+			batches = append(batches, sb)
+		}
+		sb.rows = append(sb.rows, row)
+		sb.sensors = append(sb.sensors, b.sensors[i])
+	}
+
+	for _, sb := range batches {
+		var used []int
+		for i, column := range b.columns {
+			for _, row := range sb.rows {
+				if row[i] != nil {
+					used = append(used, i)
+					sb.columns = append(sb.columns, column)
+					break
+				}
+			}
+		}
+		for j, row := range sb.rows {
+			values := make([]interface{}, len(used))
+			for k, i := range used {
+				values[k] = row[i]
+			}
+			sb.rows[j] = values
+		}
+	}
+	return batches
+}
+
+// copyBatch copies a batch inside a savepoint, which is rolled back if the copy fails. It returns
+// the error of the copy, and an error if the transaction can no longer be used.
+func copyBatch(ctx context.Context, tx pgx.Tx, b *batch) (copyErr, err error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	table := pgx.Identifier(strings.Split(b.table, "."))
+	if _, copyErr = sp.CopyFrom(ctx, table, b.columns, pgx.CopyFromRows(b.rows)); copyErr != nil {
+		return copyErr, sp.Rollback(ctx)
+	}
+	return nil, sp.Commit(ctx)
+}
+
+// writeBatches copies the batches in a transaction. When the rows of a table are rejected, they're
+// copied again one sensor at a time, and the rows of the sensors that are still rejected are
+// logged and dropped; the returned error means that the transaction can no longer be used.
+func writeBatches(ctx context.Context, tx pgx.Tx, batches []*batch) error {
+	for _, b := range batches {
+		copyErr, err := copyBatch(ctx, tx, b)
+		if err != nil {
+			return err
+		}
+		if copyErr == nil {
+			continue
+		}
+
+		for _, sb := range b.bySensor() {
+			copyErr, err := copyBatch(ctx, tx, sb)
+			if err != nil {
+				return err
+			}
+			if copyErr != nil {
+				log.Printf("error sending metrics from %s: error writing %d rows to %s: %s",
+					sb.sensors[0], len(sb.rows), sb.table, copyErr)
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes the batch in a single transaction. The rows rejected by the database are logged
+// with the names of their sensors and dropped, while the whole batch is kept for the next flush if
+// the database can't be reached.
+func (s *Sink) Flush(ctx context.Context) error {
+	if len(s.points) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, db.DBConnTimeout)
+	defer cancel()
+
+	keep := func(err error) error {
+		return fmt.Errorf("error writing rows to DB: %w (keeping %d points for the next attempt)", err, len(s.points))
+	}
+
+	if !s.prepared {
+		if err := s.prepare(ctx); err != nil {
+			return keep(err)
+		}
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return keep(err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := writeBatches(ctx, tx, makeBatches(s.points, s.statsTable)); err != nil {
+		return keep(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return keep(err)
+	}
+
+	s.points = s.points[:0]
+	return nil
+}
+
+// prepare applies the migrations and creates the missing tables when migrate is set, or checks that
+// the tables exist otherwise.
+func (s *Sink) prepare(ctx context.Context) error {
+	if s.migrate {
+		if err := s.Migrate(ctx); err != nil {
+			return err
+		}
+	} else if err := s.checkTables(ctx); err != nil {
+		return err
+	}
+
+	s.prepared = true
+	return nil
+}
+
+// sensorTables returns the tables of the sensors and the statistics table, each with the table of
+// doc/schema.sql whose columns it must have.
+func (s *Sink) sensorTables() []config.Table {
+	tables := s.tables
+	if s.statsTable != "" {
+		tables = append(tables[:len(tables):len(tables)], config.Table{Name: s.statsTable, Schema: statsSchema})
+	}
+	return tables
+}
+
+// checkTables returns an error naming the tables that don't exist.
+func (s *Sink) checkTables(ctx context.Context) error {
+	var missing []string
+	for _, table := range s.sensorTables() {
+		var exists bool
+		if err := s.pool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table.Name).Scan(&exists); err != nil {
+			return fmt.Errorf("checking table %s: %w", table.Name, err)
+		}
+		if !exists {
+			missing = append(missing, table.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables %s: create them from doc/schema.sql, or set migrate = true",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Unflushed returns the points kept after a failed flush, and forgets them.
+func (s *Sink) Unflushed() []sink.Point {
+	points := s.points
+	s.points = nil
+	return points
+}
+
+// Close writes the last batch and closes the connections.
+func (s *Sink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), db.DBConnTimeout)
+	defer cancel()
+
+	err := s.Flush(ctx)
+	s.pool.Close()
+	return err
+}
@@ -0,0 +1,359 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+var ts = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+type measurement struct {
+	q sensors.Quantity
+	u sensors.Unit
+	v float64
+}
+
+func testPoint(sensor *sensors.Sensor, stats []sensors.Stats, measurements ...measurement) sink.Point {
+	r := &sensors.Reading{Time: ts, Name: sensor.Name}
+	for _, m := range measurements {
+		r.Add(m.q, m.u, m.v)
+	}
+	return sink.Point{Time: ts, Sensor: sensor, Reading: r, Stats: stats}
+}
+
+func TestMakeBatches(t *testing.T) {
+	bedroom := &sensors.Sensor{Name: "bedroom", DBTable: "home_temperature"}
+	studio := &sensors.Sensor{Name: "studio", DBTable: "home_temperature"}
+	ficus := &sensors.Sensor{
+		Name: "ficus", DBTable: "public.home_plants",
+		Columns: map[sensors.Quantity]string{sensors.Illuminance: "lux"},
+	}
+
+	temperature := measurement{sensors.Temperature, sensors.UnitCelsius, 21.5}
+	humidity := measurement{sensors.Humidity, sensors.UnitPercent, 40}
+	reedSwitch := measurement{sensors.ReedSwitch, sensors.UnitBoolean, 1}
+	illuminance := measurement{sensors.Illuminance, sensors.UnitLux, 1200}
+
+	tests := []struct {
+		name       string
+		points     []sink.Point
+		statsTable string
+		want       []*batch
+	}{
+		{
+			name:   "no points",
+			points: nil,
+			want:   nil,
+		},
+		{
+			name: "union of the columns",
+			points: []sink.Point{
+				testPoint(bedroom, nil, temperature),
+				testPoint(studio, nil, humidity, reedSwitch),
+			},
+			want: []*batch{{
+				table:   "home_temperature",
+				columns: []string{"time", "room", "temperature", "humidity", "reed_switch"},
+				rows: [][]interface{}{
+					{ts, "bedroom", 21.5, nil, nil},
+					{ts, "studio", nil, 40.0, true},
+				},
+				sensors: []string{"bedroom", "studio"},
+			}},
+		},
+		{
+			name: "tables and renamed columns",
+			points: []sink.Point{
+				testPoint(ficus, nil, illuminance),
+				testPoint(bedroom, nil, temperature, humidity),
+				testPoint(ficus, nil, temperature),
+			},
+			want: []*batch{
+				{
+					table:   "public.home_plants",
+					columns: []string{"time", "room", "lux", "temperature"},
+					rows: [][]interface{}{
+						{ts, "ficus", 1200.0, nil},
+						{ts, "ficus", nil, 21.5},
+					},
+					sensors: []string{"ficus", "ficus"},
+				},
+				{
+					table:   "home_temperature",
+					columns: []string{"time", "room", "temperature", "humidity"},
+					rows:    [][]interface{}{{ts, "bedroom", 21.5, 40.0}},
+					sensors: []string{"bedroom"},
+				},
+			},
+		},
+		{
+			name: "stats rows",
+			points: []sink.Point{
+				testPoint(bedroom, []sensors.Stats{
+					{Quantity: sensors.Temperature, Min: 20, Max: 22, Mean: 21, Last: 21.5, Count: 3},
+					{Quantity: sensors.Humidity, Min: 40, Max: 40, Mean: 40, Last: 40, Count: 1},
+				}, temperature, humidity),
+				testPoint(studio, nil, temperature),
+				testPoint(ficus, []sensors.Stats{
+					{Quantity: sensors.Illuminance, Min: 1000, Max: 1200, Mean: 1100, Last: 1200, Count: 2},
+				}, illuminance),
+			},
+			statsTable: "sensor_stats",
+			want: []*batch{
+				{
+					table:   "home_temperature",
+					columns: []string{"time", "room", "temperature", "humidity"},
+					rows: [][]interface{}{
+						{ts, "bedroom", 21.5, 40.0},
+						{ts, "studio", 21.5, nil},
+					},
+					sensors: []string{"bedroom", "studio"},
+				},
+				{
+					table:   "public.home_plants",
+					columns: []string{"time", "room", "lux"},
+					rows:    [][]interface{}{{ts, "ficus", 1200.0}},
+					sensors: []string{"ficus"},
+				},
+				{
+					table:   "sensor_stats",
+					columns: statsColumns,
+					rows: [][]interface{}{
+						{ts, "bedroom", "temperature", 20.0, 22.0, 21.0, 21.5, 3},
+						{ts, "bedroom", "humidity", 40.0, 40.0, 40.0, 40.0, 1},
+						{ts, "ficus", "lux", 1000.0, 1200.0, 1100.0, 1200.0, 2},
+					},
+					sensors: []string{"bedroom", "bedroom", "ficus"},
+				},
+			},
+		},
+		{
+			name: "stats without a stats table",
+			points: []sink.Point{
+				testPoint(bedroom, []sensors.Stats{
+					{Quantity: sensors.Temperature, Min: 20, Max: 22, Mean: 21, Last: 21.5, Count: 3},
+				}, temperature),
+			},
+			want: []*batch{{
+				table:   "home_temperature",
+				columns: []string{"time", "room", "temperature"},
+				rows:    [][]interface{}{{ts, "bedroom", 21.5}},
+				sensors: []string{"bedroom"},
+			}},
+		},
+		{
+			name:       "no stats rows",
+			points:     []sink.Point{testPoint(bedroom, nil, temperature)},
+			statsTable: "sensor_stats",
+			want: []*batch{{
+				table:   "home_temperature",
+				columns: []string{"time", "room", "temperature"},
+				rows:    [][]interface{}{{ts, "bedroom", 21.5}},
+				sensors: []string{"bedroom"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := makeBatches(tt.points, tt.statsTable)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d batches, want %d", len(got), len(tt.want))
+			}
+			for i, b := range got {
+				if !reflect.DeepEqual(b, tt.want[i]) {
+					t.Errorf("batch %d:\ngot  %+v\nwant %+v", i, b, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchBySensor(t *testing.T) {
+	b := batch{
+		table:   "home_temperature",
+		columns: []string{"time", "room", "temperature", "humidity", "reed_switch"},
+		rows: [][]interface{}{
+			{ts, "bedroom", 21.5, nil, nil},
+			{ts, "studio", nil, 40.0, true},
+			{ts, "bedroom", 21.6, nil, nil},
+		},
+		sensors: []string{"bedroom", "studio", "bedroom"},
+	}
+	want := []*batch{
+		{
+			table:   "home_temperature",
+			columns: []string{"time", "room", "temperature"},
+			rows:    [][]interface{}{{ts, "bedroom", 21.5}, {ts, "bedroom", 21.6}},
+			sensors: []string{"bedroom", "bedroom"},
+		},
+		{
+			table:   "home_temperature",
+			columns: []string{"time", "room", "humidity", "reed_switch"},
+			rows:    [][]interface{}{{ts, "studio", 40.0, true}},
+			sensors: []string{"studio"},
+		},
+	}
+
+	if got := b.bySensor(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+// fakeTx is a transaction that rejects the copies using an unknown column, or a NaN value.
+type fakeTx struct {
+	pgx.Tx // the methods not used by writeBatches
+
+	tables map[string][]string // the columns of each table
+	copies int
+	rows   []string // the table and sensor of each row committed
+}
+
+func (tx *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return &fakeSavepoint{tx: tx}, nil
+}
+
+type fakeSavepoint struct {
+	pgx.Tx
+
+	tx   *fakeTx
+	rows []string
+}
+
+func (sp *fakeSavepoint) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	sp.tx.copies++
+	name := strings.Join(table, ".")
+	for _, column := range columns {
+		if !contains(sp.tx.tables[name], column) {
+			return 0, fmt.Errorf("column %q of relation %q does not exist", column, name)
+		}
+	}
+
+	var n int64
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range values {
+			if f, ok := v.(float64); ok && math.IsNaN(f) {
+				return 0, errors.New("invalid value NaN")
+			}
+		}
+		sp.rows = append(sp.rows, name+"/"+values[1].(string))
+		n++
+	}
+	return n, src.Err()
+}
+
+func (sp *fakeSavepoint) Commit(ctx context.Context) error {
+	sp.tx.rows = append(sp.tx.rows, sp.rows...)
+	return nil
+}
+
+func (sp *fakeSavepoint) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWriteBatches(t *testing.T) {
+	bedroom := &sensors.Sensor{Name: "bedroom", DBTable: "home_temperature"}
+	garage := &sensors.Sensor{Name: "garage", DBTable: "home_temperature"}
+	ficus := &sensors.Sensor{Name: "ficus", DBTable: "home_plants"}
+
+	temperature := measurement{sensors.Temperature, sensors.UnitCelsius, 21.5}
+	tables := map[string][]string{
+		"home_temperature": {"time", "room", "temperature", "humidity"},
+		"home_plants":      {"time", "room", "temperature", "moisture"},
+	}
+
+	tests := []struct {
+		name   string
+		points []sink.Point
+		rows   []string
+		copies int
+		logged string
+	}{
+		{
+			name: "no errors",
+			points: []sink.Point{
+				testPoint(bedroom, nil, temperature),
+				testPoint(garage, nil, temperature),
+				testPoint(ficus, nil, temperature),
+			},
+			rows:   []string{"home_temperature/bedroom", "home_temperature/garage", "home_plants/ficus"},
+			copies: 2,
+		},
+		{
+			name: "unknown column",
+			points: []sink.Point{
+				testPoint(bedroom, nil, temperature),
+				testPoint(garage, nil, temperature, measurement{"soil_ph", sensors.UnitNone, 7}),
+				testPoint(ficus, nil, temperature),
+				testPoint(bedroom, nil, temperature),
+			},
+			rows: []string{
+				"home_temperature/bedroom", "home_temperature/bedroom", "home_plants/ficus",
+			},
+			copies: 4,
+			logged: "from garage: error writing 1 rows to home_temperature",
+		},
+		{
+			name: "invalid value",
+			points: []sink.Point{
+				testPoint(garage, nil, measurement{sensors.Humidity, sensors.UnitPercent, math.NaN()}),
+				testPoint(bedroom, nil, temperature),
+			},
+			rows:   []string{"home_temperature/bedroom"},
+			copies: 3,
+			logged: "from garage: error writing 1 rows to home_temperature",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			tx := fakeTx{tables: tables}
+			if err := writeBatches(context.Background(), &tx, makeBatches(tt.points, "")); err != nil {
+				t.Fatalf("writeBatches: %s", err)
+			}
+			if !reflect.DeepEqual(tx.rows, tt.rows) {
+				t.Errorf("got rows %q, want %q", tx.rows, tt.rows)
+			}
+			if tx.copies != tt.copies {
+				t.Errorf("got %d copies, want %d", tx.copies, tt.copies)
+			}
+
+			if tt.logged == "" && logs.Len() > 0 {
+				t.Errorf("unexpected log: %q", logs.String())
+			}
+			if tt.logged != "" && (!strings.Contains(logs.String(), tt.logged) || strings.Contains(logs.String(), "bedroom")) {
+				t.Errorf("got log %q, want only the rows of garage", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+)
+
+// Point is a reading to be stored, along with the sensor that produced it and the statistics of
+// the readings received since the previous point.
+type Point struct {
+	Time    time.Time
+	Sensor  *sensors.Sensor
+	Reading *sensors.Reading
+	Stats   []sensors.Stats
+}
+
+// Sink is a storage backend for the sensor readings.
+type Sink interface {
+	// Write stores a reading.
+	Write(ctx context.Context, p Point) error
+
+	// Close releases the resources held by the sink.
+	Close() error
+}
+
+// Flusher is implemented by the sinks that buffer the points; Flush is called after each round of
+// writes, and a failed flush should keep the points for the next one.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Unflusher is implemented by the Flushers that can give back the points of a failed flush, so that
+// they can be spooled on disk instead of being kept in memory.
+type Unflusher interface {
+	// Unflushed returns the points kept after a failed flush, and forgets them.
+	Unflushed() []Point
+}
+
+// Batcher is implemented by the Flushers that flush by themselves once BatchSize points are
+// buffered.
+type Batcher interface {
+	BatchSize() int
+}
+
+// SensorNames returns the names of the sensors of a list of points, in order and without duplicates.
+func SensorNames(points []Point) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, p := range points {
+		if !seen[p.Reading.Name] {
+			seen[p.Reading.Name] = true
+			names = append(names, p.Reading.Name)
+		}
+	}
+	return names
+}
+
+// OpenFunc creates a sink from its configuration.
+type OpenFunc func(ctx context.Context, config *config.SinkConfig) (Sink, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]OpenFunc)
+)
+
+// Register makes a sink backend available under the given type name; like the sensor drivers,
+// backends register themselves from an init() function. It panics if open is nil or if a backend
+// with the same name was already registered.
+func Register(name string, open OpenFunc) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if open == nil {
+		panic("sink: Register called with a nil OpenFunc")
+	}
+	if _, dup := backends[name]; dup {
+		panic("sink: Register called twice for backend " + name)
+	}
+	backends[name] = open
+}
+
+// Open creates the sink described by a configuration.
+func Open(ctx context.Context, config *config.SinkConfig) (Sink, error) {
+	backendsMu.RLock()
+	open, ok := backends[config.Type]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported sink type %q (supported: %v)", config.Type, Types())
+	}
+	return open(ctx, config)
+}
+
+// Types returns the sorted list of the registered backend names.
+func Types() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,405 @@
+// Package spool keeps on disk the points that a sink failed to write, and replays them in order
+// once the sink works again.
+package spool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+const (
+	// DefaultMaxSize is the size of the spool file when it's not configured.
+	DefaultMaxSize = 16 << 20
+
+	fileName = "spool.jsonl"
+
+	// maxReplay is the number of points replayed by each flush, to avoid blocking the probe for
+	// too long after a long outage.
+	maxReplay = 1000
+
+	closeTimeout = 30 * time.Second
+)
+
+// sensorInfo contains the settings of the sensor used by the sinks.
+type sensorInfo struct {
+	Name     string                      `json:"name"`
+	MAC      string                      `json:"mac"`
+	Firmware string                      `json:"firmware"`
+	DBTable  string                      `json:"dbtable"`
+	Columns  map[sensors.Quantity]string `json:"columns,omitempty"`
+}
+
+// entry is a line of the spool file.
+type entry struct {
+	Time    time.Time        `json:"time"`
+	Sensor  sensorInfo       `json:"sensor"`
+	Reading *sensors.Reading `json:"reading"`
+	Stats   []sensors.Stats  `json:"stats,omitempty"`
+}
+
+func (e *entry) point() sink.Point {
+	return sink.Point{
+		Time: e.Time,
+		Sensor: &sensors.Sensor{
+			Name:     e.Sensor.Name,
+			MAC:      e.Sensor.MAC,
+			Firmware: e.Sensor.Firmware,
+			DBTable:  e.Sensor.DBTable,
+			Columns:  e.Sensor.Columns,
+		},
+		Reading: e.Reading,
+		Stats:   e.Stats,
+	}
+}
+
+// Spool wraps a sink; the points that the sink fails to write are appended to a file, and the
+// following points are queued behind them until the spool has been replayed, so that the sink
+// always receives the points in order. When the file reaches its maximum size the new points are
+// dropped.
+type Spool struct {
+	sink    sink.Sink
+	name    string
+	path    string
+	maxSize int64
+
+	mu     sync.Mutex
+	size   int64
+	depth  int
+	oldest time.Time
+}
+
+// New wraps a sink with a spool stored in dir, loading the points left by a previous run.
+func New(s sink.Sink, name, dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating the spool directory: %w", err)
+	}
+
+	sp := Spool{
+		sink:    s,
+		name:    name,
+		path:    filepath.Join(dir, fileName),
+		maxSize: maxSize,
+	}
+
+	entries, err := sp.load()
+	if err != nil {
+		return nil, err
+	}
+	// the file is rewritten without the corrupted lines, so that the next point isn't appended
+	// to a truncated one.
+	if err := sp.rewrite(entries); err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		log.Printf("spool %s: %d points left by a previous run", sp.name, sp.depth)
+	}
+
+	return &sp, nil
+}
+
+// load reads the points in the spool file; a truncated or corrupted line, as left by a crash while
+// writing, is skipped.
+func (sp *Spool) load() ([][]byte, error) {
+	data, err := os.ReadFile(sp.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading spool: %w", err)
+	}
+
+	var entries [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			log.Printf("spool %s: skipping a corrupted entry", sp.name)
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, nil
+}
+
+// setEntries updates the statistics of the spool from its content.
+func (sp *Spool) setEntries(entries [][]byte) {
+	var size int64
+	for _, line := range entries {
+		size += int64(len(line)) + 1
+	}
+
+	var oldest time.Time
+	if len(entries) > 0 {
+		var e entry
+		if err := json.Unmarshal(entries[0], &e); err == nil {
+			oldest = e.Time
+		}
+	}
+
+	sp.mu.Lock()
+	sp.size = size
+	sp.depth = len(entries)
+	sp.oldest = oldest
+	sp.mu.Unlock()
+}
+
+// Stats returns the number of points waiting in the spool and the time of the oldest one.
+func (sp *Spool) Stats() (depth int, oldest time.Time) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.depth, sp.oldest
+}
+
+// Name returns the name of the spool, which is the type of the wrapped sink.
+func (sp *Spool) Name() string {
+	return sp.name
+}
+
+// Write sends a point to the sink, or appends it to the spool if the sink fails or if older points
+// are still waiting.
+func (sp *Spool) Write(ctx context.Context, p sink.Point) error {
+	if depth, _ := sp.Stats(); depth == 0 {
+		err := sp.sink.Write(ctx, p)
+		if err == nil {
+			return nil
+		}
+		log.Printf("spool %s: spooling the point from %s: %s", sp.name, p.Sensor.Name, err)
+	}
+
+	return sp.append(p)
+}
+
+func (sp *Spool) append(p sink.Point) error {
+	e := entry{
+		Time: p.Time,
+		Sensor: sensorInfo{
+			Name:     p.Sensor.Name,
+			MAC:      p.Sensor.MAC,
+			Firmware: p.Sensor.Firmware,
+			DBTable:  p.Sensor.DBTable,
+			Columns:  p.Sensor.Columns,
+		},
+		Reading: p.Reading,
+		Stats:   p.Stats,
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding spool entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	sp.mu.Lock()
+	full := sp.size+int64(len(line)) > sp.maxSize
+	sp.mu.Unlock()
+	if full {
+		return fmt.Errorf("spool %s is full (%d bytes), dropping the point", sp.name, sp.maxSize)
+	}
+
+	fh, err := os.OpenFile(sp.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("opening spool: %w", err)
+	}
+	if _, err := fh.Write(line); err != nil {
+		fh.Close()
+		return fmt.Errorf("writing spool: %w", err)
+	}
+	// the spool must survive a power cut.
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return fmt.Errorf("writing spool: %w", err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("writing spool: %w", err)
+	}
+
+	sp.mu.Lock()
+	if sp.depth == 0 {
+		sp.oldest = p.Time
+	}
+	sp.size += int64(len(line))
+	sp.depth++
+	sp.mu.Unlock()
+
+	return nil
+}
+
+// Flush flushes the wrapped sink, then replays the spooled points, stopping at the first point
+// that the sink fails to write. The points of a failed flush are moved to the spool when the sink
+// can give them back.
+func (sp *Spool) Flush(ctx context.Context) error {
+	f, isFlusher := sp.sink.(sink.Flusher)
+	if isFlusher {
+		if err := f.Flush(ctx); err != nil {
+			for _, p := range sp.unflushed() {
+				if err := sp.append(p); err != nil {
+					log.Printf("spool %s: %s", sp.name, err)
+				}
+			}
+			return err
+		}
+	}
+
+	if depth, _ := sp.Stats(); depth == 0 {
+		return nil
+	}
+
+	entries, err := sp.load()
+	if err != nil {
+		return err
+	}
+
+	// a sink flushing by itself mid-replay would commit the points of a replay that fails later,
+	// and they would be sent again: the spool is replayed in chunks that the sink flushes at most
+	// once, and rewritten after each of them.
+	chunk := maxReplay
+	if b, ok := sp.sink.(sink.Batcher); ok && b.BatchSize() > 0 && b.BatchSize() < chunk {
+		chunk = b.BatchSize()
+	}
+
+	var sent int
+	for err == nil && sent < len(entries) && sent < maxReplay {
+		end := sent + chunk
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if end > maxReplay {
+			end = maxReplay
+		}
+
+		var n int
+		n, err = sp.replay(ctx, entries[sent:end])
+		if n == 0 {
+			break
+		}
+		sent += n
+		if err := sp.rewrite(entries[sent:]); err != nil {
+			return err
+		}
+	}
+
+	depth, oldest := sp.Stats()
+	if depth > 0 {
+		log.Printf("spool %s: replayed %d points, %d left (oldest from %s ago)",
+			sp.name, sent, depth, time.Since(oldest).Truncate(time.Second))
+	} else {
+		log.Printf("spool %s: replayed %d points", sp.name, sent)
+	}
+
+	if err != nil {
+		return fmt.Errorf("replaying spool %s: %w", sp.name, err)
+	}
+	return nil
+}
+
+// replay writes a chunk of the spool to the sink and flushes it, stopping at the first point that
+// the sink fails to write; it returns the number of entries that can be removed from the spool.
+func (sp *Spool) replay(ctx context.Context, entries [][]byte) (int, error) {
+	var (
+		sent int
+		err  error
+	)
+	for sent < len(entries) {
+		var e entry
+		if err := json.Unmarshal(entries[sent], &e); err != nil {
+			log.Printf("spool %s: skipping an invalid entry: %s", sp.name, err)
+			sent++
+			continue
+		}
+		if err = sp.sink.Write(ctx, e.point()); err != nil {
+			break
+		}
+		sent++
+	}
+
+	if f, ok := sp.sink.(sink.Flusher); ok && sent > 0 {
+		if ferr := f.Flush(ctx); ferr != nil {
+			// the points are still in the spool.
+			sp.unflushed()
+			return 0, ferr
+		}
+	}
+	return sent, err
+}
+
+// unflushed takes the points of a failed flush from the wrapped sink.
+func (sp *Spool) unflushed() []sink.Point {
+	if u, ok := sp.sink.(sink.Unflusher); ok {
+		return u.Unflushed()
+	}
+	return nil
+}
+
+// rewrite replaces the spool file with the points not replayed yet.
+func (sp *Spool) rewrite(entries [][]byte) error {
+	if len(entries) == 0 {
+		if err := os.Remove(sp.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("removing spool: %w", err)
+		}
+		sp.setEntries(nil)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range entries {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp := sp.path + ".tmp"
+	if err := writeFile(tmp, buf.Bytes()); err != nil {
+		return fmt.Errorf("writing spool: %w", err)
+	}
+	if err := os.Rename(tmp, sp.path); err != nil {
+		return fmt.Errorf("writing spool: %w", err)
+	}
+
+	sp.setEntries(entries)
+	return nil
+}
+
+// writeFile writes a file and syncs it to the disk.
+func writeFile(name string, data []byte) error {
+	fh, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// Close flushes the wrapped sink, spooling the points it fails to write, and closes it; the
+// spooled points are kept for the next run.
+func (sp *Spool) Close() error {
+	if _, ok := sp.sink.(sink.Flusher); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+
+		if err := sp.Flush(ctx); err != nil {
+			log.Printf("spool %s: %s", sp.name, err)
+		}
+	}
+	return sp.sink.Close()
+}
@@ -0,0 +1,287 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+var errDown = errors.New("the sink is down")
+
+// fakeSink buffers the points like the database sinks: a flush commits them, and a full batch is
+// flushed by Write.
+type fakeSink struct {
+	batchSize int
+	down      bool // Write and Flush fail
+	flushes   int  // the number of flushes that succeed before down is set; 0 for no limit
+
+	buffer    []sink.Point
+	committed []int
+}
+
+func (f *fakeSink) Write(ctx context.Context, p sink.Point) error {
+	if f.down {
+		return errDown
+	}
+	f.buffer = append(f.buffer, p)
+	if f.batchSize > 0 && len(f.buffer) >= f.batchSize {
+		f.Flush(ctx)
+	}
+	return nil
+}
+
+func (f *fakeSink) Flush(ctx context.Context) error {
+	if len(f.buffer) == 0 {
+		return nil
+	}
+	if f.down {
+		return errDown
+	}
+	for _, p := range f.buffer {
+		f.committed = append(f.committed, seq(p))
+	}
+	f.buffer = nil
+
+	if f.flushes > 0 {
+		f.flushes--
+		f.down = f.flushes == 0
+	}
+	return nil
+}
+
+func (f *fakeSink) Unflushed() []sink.Point {
+	points := f.buffer
+	f.buffer = nil
+	return points
+}
+
+func (f *fakeSink) BatchSize() int {
+	return f.batchSize
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+// point returns a point whose temperature is its sequence number.
+func point(n int) sink.Point {
+	r := &sensors.Reading{Time: time.Unix(int64(1700000000+n), 0)}
+	r.Add(sensors.Temperature, sensors.UnitCelsius, float64(n))
+	return sink.Point{
+		Time:    r.Time,
+		Sensor:  &sensors.Sensor{Name: "bedroom", DBTable: "home_temperature"},
+		Reading: r,
+	}
+}
+
+func seq(p sink.Point) int {
+	m, _ := p.Reading.Get(sensors.Temperature)
+	return int(m.Value)
+}
+
+func sequence(from, to int) []int {
+	var result []int
+	for n := from; n < to; n++ {
+		result = append(result, n)
+	}
+	return result
+}
+
+func newTest(t *testing.T, f *fakeSink, dir string) *Spool {
+	t.Helper()
+	sp, err := New(f, "fake", dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+// spooled returns the sequence numbers of the points in the spool file.
+func spooled(t *testing.T, sp *Spool) []int {
+	t.Helper()
+	entries, err := sp.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []int
+	for _, line := range entries {
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, seq(e.point()))
+	}
+	return result
+}
+
+func write(t *testing.T, sp *Spool, from, to int) {
+	t.Helper()
+	for n := from; n < to; n++ {
+		if err := sp.Write(context.Background(), point(n)); err != nil {
+			t.Fatalf("Write(%d): %s", n, err)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeSink{}
+	sp := newTest(t, f, t.TempDir())
+
+	write(t, sp, 0, 2)
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the points of the failed flush are spooled, and the new ones are queued behind them.
+	f.down = true
+	write(t, sp, 2, 4)
+	if err := sp.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded while the sink is down")
+	}
+	write(t, sp, 4, 6)
+	if err := sp.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded while the sink is down")
+	}
+	if got, want := spooled(t, sp), sequence(2, 6); !reflect.DeepEqual(got, want) {
+		t.Fatalf("spooled %v, want %v", got, want)
+	}
+	if depth, oldest := sp.Stats(); depth != 4 || !oldest.Equal(point(2).Time) {
+		t.Errorf("Stats = %d, %s", depth, oldest)
+	}
+
+	f.down = false
+	write(t, sp, 6, 8)
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	write(t, sp, 8, 10)
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := f.committed, sequence(0, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed %v, want %v", got, want)
+	}
+	if depth, _ := sp.Stats(); depth != 0 {
+		t.Errorf("%d points left in the spool", depth)
+	}
+	if _, err := os.Stat(sp.path); !os.IsNotExist(err) {
+		t.Errorf("the spool file was not removed: %v", err)
+	}
+}
+
+func TestReplayBatches(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeSink{batchSize: 3, down: true}
+	sp := newTest(t, f, t.TempDir())
+
+	write(t, sp, 0, 10)
+	if got, want := spooled(t, sp), sequence(0, 10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("spooled %v, want %v", got, want)
+	}
+
+	// the sink goes down again after two flushes, the first of them made by Write when the batch
+	// is full: the committed points must not be replayed again.
+	f.down, f.flushes = false, 2
+	if err := sp.Flush(ctx); err == nil {
+		t.Fatal("Flush succeeded while the sink is down")
+	}
+	if got, want := f.committed, sequence(0, 6); !reflect.DeepEqual(got, want) {
+		t.Fatalf("committed %v, want %v", got, want)
+	}
+	if got, want := spooled(t, sp), sequence(6, 10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("spooled %v, want %v", got, want)
+	}
+
+	f.down = false
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.committed, sequence(0, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed %v, want %v", got, want)
+	}
+}
+
+func TestReplayLimit(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeSink{down: true}
+	sp := newTest(t, f, t.TempDir())
+
+	write(t, sp, 0, maxReplay+10)
+
+	f.down = false
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(f.committed); got != maxReplay {
+		t.Errorf("replayed %d points, want %d", got, maxReplay)
+	}
+	if depth, _ := sp.Stats(); depth != 10 {
+		t.Errorf("%d points left in the spool, want 10", depth)
+	}
+
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.committed, sequence(0, maxReplay+10); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed %d points, want %d in order", len(got), len(want))
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	sp := newTest(t, &fakeSink{down: true}, dir)
+	write(t, sp, 0, 3)
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while appending leaves a truncated line.
+	fh, err := os.OpenFile(filepath.Join(dir, fileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(`{"time":"2023-11`)
+	fh.Close()
+
+	f := &fakeSink{}
+	sp = newTest(t, f, dir)
+	if depth, _ := sp.Stats(); depth != 3 {
+		t.Fatalf("loaded %d points, want 3", depth)
+	}
+
+	// the new points are queued behind the ones of the previous run.
+	write(t, sp, 3, 5)
+	if err := sp.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.committed, sequence(0, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("committed %v, want %v", got, want)
+	}
+}
+
+func TestFull(t *testing.T) {
+	f := &fakeSink{down: true}
+	sp, err := New(f, "fake", t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sp.Write(context.Background(), point(0)); err == nil {
+		t.Error("Write succeeded with a full spool")
+	}
+	if depth, _ := sp.Stats(); depth != 0 {
+		t.Errorf("%d points in a full spool", depth)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package sqlite
+
+// The pure-Go SQLite driver, which builds with CGO_ENABLED=0; it's kept behind a build tag to keep
+// the default build small, and buildable with the older Go versions.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,71 @@
+package sqlite
+
+// schemas are the columns of the tables of doc/schema.sql, by table name; the table of each sensor
+// is created with the columns of the table used by its driver.
+var schemas = map[string]string{
+	"home_temperature": `
+  time TIMESTAMP NOT NULL,
+  room TEXT NOT NULL,
+  temperature DOUBLE PRECISION NULL,
+  humidity DOUBLE PRECISION NULL,
+  battery DOUBLE PRECISION NULL,
+  voltage DOUBLE PRECISION NULL,
+  reed_switch BOOLEAN NULL,
+  trigger_output BOOLEAN NULL,
+  trigger_control BOOLEAN NULL,
+  temperature_trigger BOOLEAN NULL,
+  humidity_trigger BOOLEAN NULL,
+  pressure INTEGER NULL,
+  txpower INTEGER NULL,
+  acceleration_x DOUBLE PRECISION NULL,
+  acceleration_y DOUBLE PRECISION NULL,
+  acceleration_z DOUBLE PRECISION NULL,
+  movement_counter INTEGER NULL,
+  sequence INTEGER NULL,
+  co2 INTEGER NULL,
+  co2_status SMALLINT NULL,
+  pm1_0 DOUBLE PRECISION NULL,
+  pm2_5 DOUBLE PRECISION NULL,
+  pm4_0 DOUBLE PRECISION NULL,
+  pm10 DOUBLE PRECISION NULL,
+  voc INTEGER NULL,
+  nox INTEGER NULL,
+  luminosity DOUBLE PRECISION NULL
+`,
+	"home_bthome": `
+  time TIMESTAMP NOT NULL,
+  room TEXT NOT NULL,
+  temperature DOUBLE PRECISION NULL,
+  humidity DOUBLE PRECISION NULL,
+  pressure DOUBLE PRECISION NULL,
+  illuminance DOUBLE PRECISION NULL,
+  battery DOUBLE PRECISION NULL,
+  voltage DOUBLE PRECISION NULL,
+  co2 INTEGER NULL,
+  motion BOOLEAN NULL,
+  window BOOLEAN NULL,
+  button SMALLINT NULL
+`,
+	"home_plants": `
+  time TIMESTAMP NOT NULL,
+  room TEXT NOT NULL,
+  temperature DOUBLE PRECISION NULL,
+  moisture SMALLINT NULL,
+  conductivity INTEGER NULL,
+  lux INTEGER NULL,
+  battery DOUBLE PRECISION NULL
+`,
+	statsSchema: `
+  time TIMESTAMP NOT NULL,
+  room TEXT NOT NULL,
+  quantity TEXT NOT NULL,
+  min DOUBLE PRECISION NOT NULL,
+  max DOUBLE PRECISION NOT NULL,
+  mean DOUBLE PRECISION NOT NULL,
+  last DOUBLE PRECISION NOT NULL,
+  samples INTEGER NOT NULL
+`,
+}
+
+// statsSchema is the table of doc/schema.sql with the columns of the statistics table.
+const statsSchema = "sensor_stats"
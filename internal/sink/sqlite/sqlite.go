@@ -0,0 +1,243 @@
+// SQLite storage backend, for the probes that keep their readings on the local disk.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+// Type is the name of the SQLite backend in the configuration file.
+const Type = "sqlite"
+
+// driverName is the name of the database/sql driver, registered by the pure-Go modernc.org/sqlite
+// package when the program is built with the "sqlite" tag.
+const driverName = "sqlite"
+
+const (
+	// maxPoints is the number of points kept while the database can't be written; the oldest ones
+	// are dropped first.
+	maxPoints = 10000
+
+	closeTimeout = 30 * time.Second
+)
+
+func init() {
+	sink.Register(Type, func(ctx context.Context, config *config.SinkConfig) (sink.Sink, error) {
+		s, err := Open(ctx, config.Path)
+		if err != nil {
+			return nil, err
+		}
+		s.statsTable = config.StatsTable
+
+		if err := s.createTables(ctx, config.Tables); err != nil {
+			s.db.Close()
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// Sink buffers the readings and inserts them in a single transaction when flushed. Like the
+// PostgreSQL backend, each reading is written to the table set in the sensor's "dbtable" setting,
+// and the sensors without a table are skipped; the tables are created when the sink is opened,
+// with the columns of doc/schema.sql.
+type Sink struct {
+	db         *sql.DB
+	statsTable string // the table of the interval statistics, if any
+
+	points []sink.Point
+}
+
+// Open opens (or creates) the database file and switches it to WAL mode.
+func Open(ctx context.Context, path string) (*Sink, error) {
+	if path == "" {
+		return nil, errors.New("the SQLite database path is missing")
+	}
+	if !hasDriver() {
+		return nil, errors.New("SQLite support is not available in this build (build with the \"sqlite\" tag)")
+	}
+
+	db, err := sql.Open(driverName, path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection, so that the writes are serialized.
+	db.SetMaxOpenConns(1)
+
+	var mode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode=WAL").Scan(&mode); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	if !strings.EqualFold(mode, "wal") {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: can't enable WAL mode (journal mode is %q)", path, mode)
+	}
+
+	return &Sink{db: db}, nil
+}
+
+func hasDriver() bool {
+	for _, name := range sql.Drivers() {
+		if name == driverName {
+			return true
+		}
+	}
+	return false
+}
+
+// quote quotes an identifier.
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Write adds a reading to the next batch.
+func (s *Sink) Write(ctx context.Context, p sink.Point) error {
+	if p.Sensor.DBTable == "" {
+		return nil
+	}
+
+	s.points = append(s.points, p)
+	if len(s.points) > maxPoints {
+		log.Printf("SQLite: dropping %d points", len(s.points)-maxPoints)
+		s.points = s.points[len(s.points)-maxPoints:]
+	}
+	return nil
+}
+
+// createTables creates the tables of the sensors and the statistics table, if missing, each with
+// the columns of its table in doc/schema.sql.
+func (s *Sink) createTables(ctx context.Context, tables []config.Table) error {
+	if s.statsTable != "" {
+		tables = append(tables, config.Table{Name: s.statsTable, Schema: statsSchema})
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		columns, ok := schemas[table.Schema]
+		if !ok {
+			return fmt.Errorf("creating table %s: unknown schema %q", table.Name, table.Schema)
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s (%s)", quote(table.Name), columns,
+		)); err != nil {
+			return fmt.Errorf("creating table %s: %w", table.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"CREATE INDEX IF NOT EXISTS %s ON %s (time)", quote(table.Name+"_time_idx"), quote(table.Name),
+		)); err != nil {
+			return fmt.Errorf("creating index on %s: %w", table.Name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertStats writes the statistics of a point.
+func (s *Sink) insertStats(ctx context.Context, tx *sql.Tx, p sink.Point) error {
+	for _, st := range p.Stats {
+		if _, err := tx.ExecContext(ctx,
+			fmt.Sprintf("INSERT INTO %s(time,room,quantity,min,max,mean,last,samples) VALUES(?,?,?,?,?,?,?,?)",
+				quote(s.statsTable)),
+			p.Time.UTC(), p.Sensor.Name, p.Sensor.Column(st.Quantity), st.Min, st.Max, st.Mean, st.Last, st.Count,
+		); err != nil {
+			return fmt.Errorf("error writing row to %s: %w", s.statsTable, err)
+		}
+	}
+
+	return nil
+}
+
+// insert writes a point; like with PostgreSQL, a quantity without a column makes the insert fail.
+func (s *Sink) insert(ctx context.Context, tx *sql.Tx, p sink.Point) error {
+	table := p.Sensor.DBTable
+	columnNames := []string{"time", "room"}
+	placeholders := []string{"?", "?"}
+	args := []interface{}{p.Time.UTC(), p.Sensor.Name}
+	for _, m := range p.Reading.Measurements {
+		var value interface{} = m.Value
+		if m.Unit == sensors.UnitBoolean {
+			value = m.Bool()
+		}
+
+		columnNames = append(columnNames, quote(p.Sensor.Column(m.Quantity)))
+		placeholders = append(placeholders, "?")
+		args = append(args, value)
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)",
+			quote(table), strings.Join(columnNames, ","), strings.Join(placeholders, ",")),
+		args...,
+	); err != nil {
+		return fmt.Errorf("error writing row to %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// Flush inserts the batch in a single transaction; the points that can't be inserted are logged
+// and dropped, while the whole batch is kept for the next flush if the transaction fails.
+func (s *Sink) Flush(ctx context.Context) error {
+	if len(s.points) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%w (keeping %d points for the next attempt)", err, len(s.points))
+	}
+
+	for _, p := range s.points {
+		if err := s.insert(ctx, tx, p); err != nil {
+			log.Printf("error sending metrics from %s: %s", p.Sensor.Name, err)
+		}
+		if s.statsTable != "" && len(p.Stats) > 0 {
+			if err := s.insertStats(ctx, tx, p); err != nil {
+				log.Printf("error sending metrics from %s: %s", p.Sensor.Name, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%w (keeping %d points for the next attempt)", err, len(s.points))
+	}
+
+	s.points = s.points[:0]
+	return nil
+}
+
+// Unflushed returns the points kept after a failed flush, and forgets them.
+func (s *Sink) Unflushed() []sink.Point {
+	points := s.points
+	s.points = nil
+	return points
+}
+
+// Close writes the last batch and closes the database.
+func (s *Sink) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	err := s.Flush(ctx)
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+//go:build sqlite
+
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/piger/sensor-probe/internal/config"
+	"github.com/piger/sensor-probe/internal/sensors"
+	"github.com/piger/sensor-probe/internal/sink"
+)
+
+func openTest(t *testing.T) *Sink {
+	t.Helper()
+	s, err := sink.Open(context.Background(), &config.SinkConfig{
+		Type:       Type,
+		Path:       filepath.Join(t.TempDir(), "sensors.db"),
+		StatsTable: "stats",
+		Tables: []config.Table{
+			{Name: "temperature", Schema: sensors.DefaultTable},
+			{Name: "plants", Schema: "home_plants"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.(*Sink)
+}
+
+func TestOpenUnknownSchema(t *testing.T) {
+	_, err := sink.Open(context.Background(), &config.SinkConfig{
+		Type:   Type,
+		Path:   filepath.Join(t.TempDir(), "sensors.db"),
+		Tables: []config.Table{{Name: "temperature", Schema: "home_nothing"}},
+	})
+	if err == nil {
+		t.Fatal("Open succeeded with an unknown schema")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	ctx := context.Background()
+	s := openTest(t)
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	bedroom := &sensors.Sensor{Name: "bedroom", DBTable: "temperature"}
+	r := &sensors.Reading{Time: ts}
+	r.Add(sensors.Temperature, sensors.UnitCelsius, 21.5)
+	r.AddBool(sensors.ReedSwitch, true)
+	stats := []sensors.Stats{{Quantity: sensors.Temperature, Min: 20, Max: 22, Mean: 21, Last: 21.5, Count: 3}}
+
+	// the columns of the tables are created up front, so a reading without a column is dropped.
+	ficus := &sensors.Sensor{Name: "ficus", DBTable: "plants"}
+	bad := &sensors.Reading{Time: ts}
+	bad.Add(sensors.Humidity, sensors.UnitPercent, 40)
+
+	for _, p := range []sink.Point{
+		{Time: ts, Sensor: bedroom, Reading: r, Stats: stats},
+		{Time: ts, Sensor: ficus, Reading: bad},
+		{Time: ts, Sensor: &sensors.Sensor{Name: "skipped"}, Reading: r},
+	} {
+		if err := s.Write(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if len(s.points) != 0 {
+		t.Errorf("%d points left after a flush", len(s.points))
+	}
+
+	var (
+		room        string
+		temperature float64
+		reedSwitch  bool
+		humidity    *float64
+	)
+	if err := s.db.QueryRow("SELECT room, temperature, reed_switch, humidity FROM temperature").Scan(
+		&room, &temperature, &reedSwitch, &humidity,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if room != "bedroom" || temperature != 21.5 || !reedSwitch || humidity != nil {
+		t.Errorf("got row (%s, %v, %v, %v)", room, temperature, reedSwitch, humidity)
+	}
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM plants").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("got %d rows in plants, want 0", count)
+	}
+
+	var (
+		quantity          string
+		min, max, mean, l float64
+		samples           int
+	)
+	if err := s.db.QueryRow("SELECT quantity, min, max, mean, last, samples FROM stats").Scan(
+		&quantity, &min, &max, &mean, &l, &samples,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if quantity != "temperature" || min != 20 || max != 22 || mean != 21 || l != 21.5 || samples != 3 {
+		t.Errorf("got stats row (%s, %v, %v, %v, %v, %d)", quantity, min, max, mean, l, samples)
+	}
+}
+
+func TestUnflushed(t *testing.T) {
+	ctx := context.Background()
+	s := openTest(t)
+
+	r := &sensors.Reading{Time: time.Now()}
+	r.Add(sensors.Temperature, sensors.UnitCelsius, 21.5)
+	sensor := &sensors.Sensor{Name: "bedroom", DBTable: "temperature"}
+	for i := 0; i < maxPoints+5; i++ {
+		if err := s.Write(ctx, sink.Point{Time: r.Time, Sensor: sensor, Reading: r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(s.Unflushed()); n != maxPoints {
+		t.Errorf("Unflushed returned %d points, want %d", n, maxPoints)
+	}
+	if n := len(s.Unflushed()); n != 0 {
+		t.Errorf("Unflushed returned %d points after forgetting them", n)
+	}
+}